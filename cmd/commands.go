@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance"
+	"github.com/aaoreshkin/click-counter/internal/provider/database"
+	"github.com/aaoreshkin/click-counter/internal/provider/migrate"
+	"github.com/aaoreshkin/click-counter/migrations"
+)
+
+// Служебные команды: click-counter <команда> [флаги].
+var commands = map[string]func(context.Context, []string) error{
+	"backfill": backfill,
+	"migrate":  migrateCommand,
+}
+
+// Использование команды migrate.
+const migrateUsage = `usage: click-counter migrate <command>
+  up [N]         apply all or N pending migrations
+  down N | -all  roll back N or all applied migrations
+  goto V [-all]  migrate up or down to version V (-all: required below the first migration)
+  force V        set version V without running migrations (-1: no version)
+  status         print current version and migrations`
+
+// Считает часовые и дневные агрегаты за историю, накопленную до их появления.
+// Можно запускать при работающем сервисе и прерывать: повторный запуск продолжит с места остановки.
+//
+//	click-counter backfill [-from 2025-07-01]
+func backfill(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := flags.String("from", "", "first day to roll up, YYYY-MM-DD in UTC (default: earliest data)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var start time.Time
+
+	if *from != "" {
+		var err error
+		if start, err = time.Parse(time.DateOnly, *from); err != nil {
+			return fmt.Errorf("invalid -from: %s", *from)
+		}
+	}
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	return maintenance.Backfill(ctx, connection, start)
+}
+
+// Применяет встроенные миграции к БД из DATABASE_URL.
+//
+//	click-counter migrate up|down|goto|force|status
+func migrateCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || !slices.Contains([]string{"up", "down", "goto", "force", "status"}, args[0]) {
+		return errors.New(migrateUsage)
+	}
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	migrator, err := migrate.New(connection, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	// Числовой аргумент команды: количество миграций или версия.
+	number := func(required bool) (int64, error) {
+		if len(args) < 2 {
+			if required {
+				return 0, errors.New(migrateUsage)
+			}
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number: %s", args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := number(false)
+		if err != nil {
+			return err
+		}
+		if err := migrator.Up(ctx, int(n)); err != nil {
+			return err
+		}
+
+	case "down":
+		// Откат всех миграций удаляет все данные, поэтому требует явного -all.
+		n := int64(0)
+		if len(args) < 2 || args[1] != "-all" {
+			if n, err = number(true); err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("invalid number: %s", args[1])
+			}
+		}
+		if err := migrator.Down(ctx, int(n)); err != nil {
+			return err
+		}
+
+	case "goto":
+		v, err := number(true)
+		if err != nil {
+			return err
+		}
+		// Переход ниже первой миграции откатывает все миграции, поэтому, как и down, требует явного -all.
+		if all := migrator.Migrations(); len(all) > 0 && v < all[0].Version && (len(args) < 3 || args[2] != "-all") {
+			return fmt.Errorf("goto %d rolls back all migrations, add -all to confirm", v)
+		}
+		if err := migrator.Goto(ctx, v); err != nil {
+			return err
+		}
+
+	case "force":
+		v, err := number(true)
+		if err != nil {
+			return err
+		}
+		if err := migrator.Force(ctx, v); err != nil {
+			return err
+		}
+
+	}
+
+	return printStatus(ctx, migrator)
+}
+
+// Выводит текущую версию схемы и список миграций с отметкой примененных.
+func printStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	version, dirty, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	state := "clean"
+	if dirty {
+		state = "dirty"
+	}
+	fmt.Fprintf(os.Stdout, "version: %d (%s), latest: %d\n", version, state, migrator.Latest())
+
+	for _, m := range migrator.Migrations() {
+		mark := "pending"
+		if m.Version <= version {
+			mark = "applied"
+		}
+		fmt.Fprintf(os.Stdout, "  %d_%s\t%s\n", m.Version, m.Name, mark)
+	}
+	return nil
+}
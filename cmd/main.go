@@ -2,13 +2,29 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // База часовых поясов для статистики: в минимальных образах ее нет.
 
 	"github.com/aaoreshkin/click-counter/internal"
 	"github.com/aaoreshkin/click-counter/internal/provider/database"
+	"github.com/aaoreshkin/click-counter/internal/provider/migrate"
 	"github.com/aaoreshkin/click-counter/internal/router"
+	"github.com/aaoreshkin/click-counter/migrations"
+)
+
+const (
+	// Время на завершение обработки текущих HTTP запросов при остановке.
+	shutdownTimeout = 10 * time.Second
+
+	// Время на финальный сброс кэша в БД при остановке.
+	flushTimeout = 5 * time.Second
 )
 
 var (
@@ -19,29 +35,72 @@ var (
 )
 
 // Точка входа.
-// Инициализирует контекст и запускает основную логику приложения.
+// Инициализирует контекст, отменяемый по SIGINT/SIGTERM, и запускает основную логику приложения
+// или служебную команду, если она передана первым аргументом (см. commands).
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	if err := run(ctx); err != nil {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Printf("Unknown command: %s", os.Args[1])
+			os.Exit(2)
+		}
+
+		if err := command(ctx, os.Args[2:]); err != nil {
+			log.Printf("Command %s error: %v", os.Args[1], err)
+			cancel()
+			os.Exit(1)
+		}
+		return
+	}
+
+	migrateOnStart := flag.Bool("migrate-on-start", false, "apply pending migrations before starting the server")
+	flag.Parse()
+
+	// Ошибка запуска (например, устаревшая схема БД) завершает процесс с ненулевым кодом,
+	// чтобы оркестратор не считал такой запуск успешным.
+	if err := run(ctx, *migrateOnStart); err != nil {
 		log.Printf("Application error: %v", err)
+		cancel()
+		os.Exit(1)
 	}
 }
 
 // Выполняет основную логику приложения:
 // - подключается к базе данных
+// - применяет миграции при migrateOnStart и отказывается запускаться, если схема БД старше кода
 // - инициализирует корневой менеджер (контролит других менеджеров отвечающих за модуль)
 // - настраивает HTTP роутер
 // - запускает HTTP сервер на порту из переменной окружения SERVICE_PORT
-func run(ctx context.Context) error {
+// - по сигналу останавливает сервер, дожидается текущих запросов и сбрасывает кэш в БД
+func run(ctx context.Context, migrateOnStart bool) error {
 	if connection, err = database.New(ctx); err != nil {
 		log.Printf("Failed to connect to database: %v", err)
 		return err
 	}
 	defer connection.Close()
 
-	manager, err := internal.New(ctx, connection)
+	migrator, err := migrate.New(connection, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	// Реплики, запущенные одновременно, применяют миграции по очереди под блокировкой.
+	if migrateOnStart {
+		if err := migrator.Up(ctx, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := migrator.Check(ctx); err != nil {
+		return err
+	}
+
+	// Модули живут до явного Shutdown, а не до сигнала:
+	// воркеры должны продолжать сброс, пока сервер дообрабатывает запросы.
+	manager, err := internal.New(context.WithoutCancel(ctx), connection)
 	if err != nil {
 		return err
 	}
@@ -59,9 +118,40 @@ func run(ctx context.Context) error {
 		MaxHeaderBytes: 1 << 10, // 1KB - минимум для заголовков
 	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Printf("HTTP server error: %v\n", err)
+	// Live-потоки не завершаются сами: закрываем их, как только сервер начинает остановку.
+	server.RegisterOnShutdown(manager.CloseStreams)
+
+	var serveErr error
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP server error: %v\n", err)
+			serveErr = err
+		}
+	case <-ctx.Done():
+		log.Println("Shutting down...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		// Перестает принимать соединения и дожидается завершения текущих запросов.
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server shutdown error: %v\n", err)
+		}
 	}
 
-	return nil
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	// Останавливает воркеры и сбрасывает оставшиеся в кэше данные до закрытия соединения с БД.
+	manager.Shutdown(flushCtx)
+
+	return serveErr
 }
@@ -1,13 +1,26 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 )
 
+var (
+	// Количество элементов в теле запроса превышает допустимое.
+	ErrTooManyItems = errors.New("too many items")
+
+	// Тело запроса или строка NDJSON превышает допустимый размер.
+	ErrTooLarge = errors.New("request body too large")
+)
+
 // Декодирует JSON из тела HTTP запроса в указанный тип T.
 // Использует дженерики для типобезопасности и возвращает указатель на декодированную структуру.
 func DecodeJSON[T any](r *http.Request) (*T, error) {
@@ -18,6 +31,69 @@ func DecodeJSON[T any](r *http.Request) (*T, error) {
 	return &payload, nil
 }
 
+// Читает список элементов из тела HTTP запроса без их декодирования.
+// Поддерживает JSON массив и NDJSON (Content-Type: application/x-ndjson, один элемент на строку).
+// Элементы возвращаются как есть, чтобы ошибка в одном из них не отменяла остальные.
+// Возвращает ErrTooManyItems, если элементов больше limit, и ErrTooLarge, если тело превысило
+// ограничение http.MaxBytesReader или строка NDJSON длиннее bufio.MaxScanTokenSize.
+func DecodeList(r *http.Request, limit int) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == limit {
+				return nil, ErrTooManyItems
+			}
+			items = append(items, bytes.Clone(line))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, bodyError(err)
+		}
+		return items, nil
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if token != json.Delim('[') {
+		return nil, errors.New("request body must be a JSON array")
+	}
+
+	for decoder.More() {
+		if len(items) == limit {
+			return nil, ErrTooManyItems
+		}
+
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, bodyError(err)
+		}
+		items = append(items, item)
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, bodyError(err)
+	}
+	return items, nil
+}
+
+// Оборачивает ошибку чтения тела запроса, превышение размера - в ErrTooLarge.
+func bodyError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) || errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w: %w", ErrTooLarge, err)
+	}
+	return fmt.Errorf("failed to decode request body: %w", err)
+}
+
 // Извлекает целочисленный параметр из URL пути HTTP запроса.
 func IntParam(r *http.Request, param string) (int, error) {
 	s := chi.URLParam(r, param)
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+const (
+	mimeJSON   = "application/json"
+	mimeCSV    = "text/csv"
+	mimeNDJSON = "application/x-ndjson"
+
+	// Количество строк выгрузки между принудительными сбросами ответа клиенту.
+	exportFlushRows = 1000
+)
+
+// Потоковая запись статистики в ответ в формате CSV или NDJSON.
+// Заголовки ответа отправляются с первой строкой, поэтому до нее ошибку еще можно вернуть статусом.
+type exporter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	format  string
+	csv     *csv.Writer   // nil для NDJSON
+	json    *json.Encoder // nil для CSV
+	record  []string      // переиспользуемая строка CSV
+	rows    int
+	started bool
+}
+
+// Новый экземпляр exporter для формата format (mimeCSV или mimeNDJSON).
+func newExporter(w http.ResponseWriter, format string) *exporter {
+	e := &exporter{
+		w:      w,
+		rc:     http.NewResponseController(w),
+		format: format,
+	}
+
+	if format == mimeCSV {
+		e.csv = csv.NewWriter(w)
+		e.record = make([]string, 4)
+	} else {
+		e.json = json.NewEncoder(w)
+	}
+	return e
+}
+
+// Выбирает формат потоковой выгрузки по заголовку Accept.
+// Пустая строка означает обычный JSON ответ.
+// Вес формата берется из наиболее точного подходящего диапазона (text/csv точнее text/*, text/* точнее */*),
+// q=0 исключает формат. Побеждает формат с наибольшим весом, при равенстве - указанный в заголовке раньше,
+// затем JSON. Если ни один формат не допустим, отвечаем JSON.
+func exportFormat(accept string) string {
+	type rank struct {
+		q           float64
+		specificity int // 0 - */*, 1 - type/*, 2 - точное совпадение, -1 - не подходит
+		position    int
+	}
+
+	offers := []string{mimeJSON, mimeCSV, mimeNDJSON}
+	ranks := make([]rank, len(offers))
+	for i := range ranks {
+		ranks[i].specificity = -1
+	}
+
+	position := 0
+	for part := range strings.SplitSeq(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		for i, offer := range offers {
+			specificity := -1
+			switch {
+			case mediatype == offer:
+				specificity = 2
+			case strings.HasSuffix(mediatype, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediatype, "*")):
+				specificity = 1
+			case mediatype == "*/*":
+				specificity = 0
+			}
+			if specificity > ranks[i].specificity {
+				ranks[i] = rank{q: q, specificity: specificity, position: position}
+			}
+		}
+		position++
+	}
+
+	best := -1
+	for i, r := range ranks {
+		if r.specificity < 0 || r.q == 0 {
+			continue
+		}
+		if best < 0 || r.q > ranks[best].q || r.q == ranks[best].q && r.position < ranks[best].position {
+			best = i
+		}
+	}
+	if best < 0 || offers[best] == mimeJSON {
+		return ""
+	}
+	return offers[best]
+}
+
+// Потоково выгружает статистику по баннеру построчно из курсора БД.
+// Память не зависит от размера периода: строки пишутся в ответ по мере чтения и периодически сбрасываются клиенту.
+// Ошибка до первой строки возвращается статусом, после - обрывает соединение,
+// чтобы клиент не принял неполную выгрузку за полную.
+func (c *Controller) exportStats(w http.ResponseWriter, r *http.Request, q model.Query, format string) {
+	e := newExporter(w, format)
+
+	err := c.usecase.StreamStats(r.Context(), q, e.write)
+	if err == nil {
+		err = e.close()
+	}
+	if err == nil {
+		return
+	}
+
+	if e.started {
+		log.Printf("Stats export aborted: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	if errors.Is(err, model.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "failed to get stats", http.StatusInternalServerError)
+}
+
+// Отправляет заголовки ответа и строку заголовков CSV.
+func (e *exporter) start() error {
+	e.started = true
+	e.w.Header().Set("Content-Type", e.format)
+
+	if e.csv != nil {
+		return e.csv.Write([]string{"ts", "v", "impressions", "conversions"})
+	}
+	return nil
+}
+
+// Записывает строку статистики. Для интервалов fill: "null" значения в CSV пустые.
+func (e *exporter) write(c model.Counter) error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	if e.csv != nil {
+		e.record[0] = c.TS.Format(time.RFC3339)
+		if c.Null {
+			e.record[1], e.record[2], e.record[3] = "", "", ""
+		} else {
+			e.record[1] = strconv.Itoa(c.V)
+			e.record[2] = strconv.Itoa(c.Impressions)
+			e.record[3] = strconv.Itoa(c.Conversions)
+		}
+		err = e.csv.Write(e.record)
+	} else {
+		err = e.json.Encode(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.rows++; e.rows%exportFlushRows == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// Сбрасывает записанные строки клиенту.
+func (e *exporter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Завершает выгрузку. Пустая выгрузка содержит только заголовки.
+func (e *exporter) close() error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	return e.flush()
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/common"
+)
+
+// Интервал heartbeat событий live-потока.
+// Позволяет клиенту отличить тихий баннер от оборванного соединения.
+const liveHeartbeat = 15 * time.Second
+
+// Транслирует значения счетчиков баннера за текущую минуту как Server-Sent Events.
+// Ожидает bannerID в параметрах запроса. Событие count приходит при изменении счетчиков,
+// событие heartbeat - каждые liveHeartbeat. Пример в Readme.
+func (c *Controller) HandleLive(w http.ResponseWriter, r *http.Request) {
+	bannerID, err := common.IntParam(r, "bannerID")
+	if err != nil {
+		http.Error(w, "invalid bannerID", http.StatusBadRequest)
+		return
+	}
+
+	updates, unsubscribe := c.usecase.Live(bannerID)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case counter, ok := <-updates:
+			// Канал закрыт: сервер останавливается.
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(counter)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: count\ndata: %s\n\n", data)
+		case t := <-heartbeat.C:
+			fmt.Fprintf(w, "event: heartbeat\ndata: {\"ts\":%q}\n\n", t.UTC().Format(time.RFC3339))
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -2,25 +2,33 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/aaoreshkin/click-counter/common"
 	"github.com/aaoreshkin/click-counter/internal/banners/model"
 )
 
+// Максимальный размер одного элемента пакетного инкремента в теле запроса.
+// Тело пакета ограничено лимитом элементов, умноженным на этот размер.
+const maxItemSize = 1 << 10
+
 type (
 	// Controller обрабатывает HTTP запросы для работы со счетчиками баннеров.
 	Controller struct {
 		usecase model.Usecase
+		limit   int // Максимальное количество элементов в пакетном инкременте.
 	}
 )
 
-// Новый экземпляр Controller с переданным usecase.
-func New(usecase model.Usecase) *Controller {
+// Новый экземпляр Controller с переданным usecase и лимитом пакетного инкремента.
+func New(usecase model.Usecase, limit int) *Controller {
 
 	return &Controller{
 		usecase,
+		limit,
 	}
 }
 
@@ -37,9 +45,80 @@ func (c *Controller) HandleClick(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Обрабатывает показы баннера, увеличивая счетчик показов на 1.
+// Ожидает bannerID в параметрах запроса. Возвращает 204 No Content.
+func (c *Controller) HandleImpression(w http.ResponseWriter, r *http.Request) {
+	c.handleMetric(w, r, model.Impression)
+}
+
+// Обрабатывает конверсии по баннеру, увеличивая счетчик конверсий на 1.
+// Ожидает bannerID в параметрах запроса. Возвращает 204 No Content.
+func (c *Controller) HandleConversion(w http.ResponseWriter, r *http.Request) {
+	c.handleMetric(w, r, model.Conversion)
+}
+
+func (c *Controller) handleMetric(w http.ResponseWriter, r *http.Request, metric model.Metric) {
+	bannerID, err := common.IntParam(r, "bannerID")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.usecase.IncrementMetric(bannerID, metric, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Обрабатывает пакетный инкремент счетчиков.
+// Ожидает в теле JSON массив или NDJSON элементов {"id": 1, "metric": "click", "delta": 5}.
+// Корректные элементы применяются за один проход, некорректные возвращаются в errors с их позицией.
+// Возвращает 413, если элементов больше лимита или тело больше лимита элементов по maxItemSize байт.
+func (c *Controller) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(c.limit)*maxItemSize)
+
+	items, err := common.DecodeList(r, c.limit)
+	if errors.Is(err, common.ErrTooManyItems) {
+		http.Error(w, "too many items", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, common.ErrTooLarge) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		increments = make([]model.Increment, 0, len(items))
+		response   model.IncrementResponse
+	)
+
+	for i, item := range items {
+		var increment model.Increment
+
+		if err := json.Unmarshal(item, &increment); err != nil {
+			response.Errors = append(response.Errors, model.ItemError{Index: i, Error: "invalid item"})
+			continue
+		}
+		if err := increment.Validate(); err != nil {
+			response.Errors = append(response.Errors, model.ItemError{Index: i, Error: err.Error()})
+			continue
+		}
+		increments = append(increments, increment)
+	}
+
+	c.usecase.IncrementBatch(increments)
+	response.Applied = len(increments)
+
+	json.NewEncoder(w).Encode(response)
+}
+
 // Возвращает статистику по баннеру за указанный период.
-// Ожидает bannerID в параметрах и JSON с полями from/to в теле запроса.
+// Ожидает bannerID в параметрах и JSON с полями from/to и необязательными granularity/timezone/fill в теле запроса.
 // Время должно быть в формате RFC3339. Пример запроса в Readme.
+// С Accept: text/csv или application/x-ndjson статистика выгружается потоково, без CTR и CR.
+// С compare_to ответ дополняется сравнением с другим периодом.
 func (c *Controller) HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	// Обертка в директории common
@@ -55,23 +134,294 @@ func (c *Controller) HandleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	from, err := time.Parse(time.RFC3339, data.From)
+	q, err := query(data)
 	if err != nil {
-		http.Error(w, "invalid from time format", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	q.BannerID = bannerID
 
-	to, err := time.Parse(time.RFC3339, data.To)
+	if format := exportFormat(r.Header.Get("Accept")); format != "" {
+		if q.Paged() || data.CompareTo != nil {
+			http.Error(w, "limit and compare_to are not supported for export", http.StatusBadRequest)
+			return
+		}
+		c.exportStats(w, r, q, format)
+		return
+	}
+
+	if q.Paged() && data.CompareTo != nil {
+		http.Error(w, "compare_to is not supported with limit", http.StatusBadRequest)
+		return
+	}
+
+	var response model.StatsResponse
+
+	if data.CompareTo != nil {
+		var (
+			compare    model.Compare
+			stats      []model.Counter
+			comparison model.Comparison
+		)
+		if compare, err = model.ParseCompare(data.CompareTo); err == nil {
+			if stats, comparison, err = c.usecase.GetStatsCompare(r.Context(), q, compare); err == nil {
+				response = model.NewStatsResponse(stats)
+				response.Comparison = &comparison
+			}
+		}
+	} else if q.Paged() {
+		var (
+			stats []model.Counter
+			next  *model.Cursor
+		)
+		if stats, next, err = c.usecase.GetStatsPage(r.Context(), []int{bannerID}, q); err == nil {
+			response = model.NewStatsResponse(stats)
+			response.NextCursor = nextCursor(next)
+		}
+	} else {
+		var stats []model.Counter
+		if stats, err = c.usecase.GetStats(r.Context(), q); err == nil {
+			response = model.NewStatsResponse(stats)
+		}
+	}
+
+	if errors.Is(err, model.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to get stats", http.StatusInternalServerError)
+		return
+	}
+	response.Unflushed = q.Unflushed
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Возвращает сводную статистику кликов баннера за период: сумму, среднее,
+// пиковый интервал и перцентили кликов по интервалам.
+// Ожидает bannerID в параметрах запроса и JSON с параметрами периода как в HandleStats, кроме fill.
+func (c *Controller) HandleSummary(w http.ResponseWriter, r *http.Request) {
+	bannerID, err := common.IntParam(r, "bannerID")
 	if err != nil {
-		http.Error(w, "invalid to time format", http.StatusBadRequest)
+		http.Error(w, "invalid bannerID", http.StatusBadRequest)
+		return
+	}
+
+	data, err := common.DecodeJSON[model.Stats](r)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	q, err := query(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	q.BannerID = bannerID
 
-	stats, err := c.usecase.GetStats(r.Context(), bannerID, from, to)
+	summary, err := c.usecase.GetSummary(r.Context(), q)
+	if errors.Is(err, model.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to get summary", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(summary)
+}
+
+// Возвращает статистику по нескольким баннерам за указанный период одним запросом.
+// Ожидает JSON с полями ids, merge и параметрами периода как в HandleStats.
+// Без merge возвращает ряды по ID баннеров, с merge - один суммарный ряд. Пример запроса в Readme.
+func (c *Controller) HandleMultiStats(w http.ResponseWriter, r *http.Request) {
+	data, err := common.DecodeJSON[model.MultiStats](r)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	q, err := query(&data.Stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if data.Merge && q.Paged() {
+		http.Error(w, "limit is not supported with merge", http.StatusBadRequest)
+		return
+	}
+	if data.CompareTo != nil {
+		http.Error(w, "compare_to is not supported for multiple banners", http.StatusBadRequest)
+		return
+	}
+
+	var response any
+
+	if q.Paged() {
+		var (
+			stats []model.Counter
+			next  *model.Cursor
+		)
+		if stats, next, err = c.usecase.GetStatsPage(r.Context(), data.IDs, q); err == nil {
+			multi := model.MultiStatsResponse{Series: make(map[int]model.StatsResponse), NextCursor: nextCursor(next)}
+			for len(stats) > 0 {
+				n := 1
+				for n < len(stats) && stats[n].ID == stats[0].ID {
+					n++
+				}
+				multi.Series[stats[0].ID] = model.NewStatsResponse(stats[:n])
+				stats = stats[n:]
+			}
+			response = multi
+		}
+	} else if data.Merge {
+		var stats []model.Counter
+		if stats, err = c.usecase.GetStatsMerged(r.Context(), data.IDs, q); err == nil {
+			merged := model.NewStatsResponse(stats)
+			merged.Unflushed = q.Unflushed
+			response = merged
+		}
+	} else {
+		var series map[int][]model.Counter
+		if series, err = c.usecase.GetStatsMulti(r.Context(), data.IDs, q); err == nil {
+			multi := model.MultiStatsResponse{Series: make(map[int]model.StatsResponse, len(series)), Unflushed: q.Unflushed}
+			for id, stats := range series {
+				s := model.NewStatsResponse(stats)
+				s.Unflushed = q.Unflushed
+				multi.Series[id] = s
+			}
+			response = multi
+		}
+	}
+
+	if errors.Is(err, model.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to get stats", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(model.StatsResponse{Stats: stats})
+	json.NewEncoder(w).Encode(response)
+}
+
+// Возвращает топ баннеров по кликам за период.
+// Ожидает параметры from, to (RFC3339), limit и unflushed в строке запроса.
+// По умолчанию период - последний час, limit - model.DefaultTopLimit. Пример запроса в Readme.
+func (c *Controller) HandleTop(w http.ResponseWriter, r *http.Request) {
+	q, err := topQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	top, err := c.usecase.GetTop(r.Context(), q)
+	if errors.Is(err, model.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to get top", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(model.TopResponse{Top: top, Unflushed: q.Unflushed})
+}
+
+// Разбирает параметры топа баннеров из строки запроса.
+// Текст ошибки предназначен для ответа клиенту.
+func topQuery(r *http.Request) (model.TopQuery, error) {
+	params := r.URL.Query()
+
+	q := model.TopQuery{
+		To:    time.Now(),
+		Limit: model.DefaultTopLimit,
+	}
+
+	var err error
+
+	if v := params.Get("to"); v != "" {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, errors.New("invalid to time format")
+		}
+	}
+
+	q.From = q.To.Add(-time.Hour)
+	if v := params.Get("from"); v != "" {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, errors.New("invalid from time format")
+		}
+	}
+
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("invalid limit")
+		}
+	}
+
+	if v := params.Get("unflushed"); v != "" {
+		if q.Unflushed, err = strconv.ParseBool(v); err != nil {
+			return q, errors.New("invalid unflushed")
+		}
+	}
+
+	return q, nil
+}
+
+// Разбирает параметры периода статистики из тела запроса.
+// Текст ошибки предназначен для ответа клиенту.
+func query(data *model.Stats) (model.Query, error) {
+	from, err := time.Parse(time.RFC3339, data.From)
+	if err != nil {
+		return model.Query{}, errors.New("invalid from time format")
+	}
+
+	to, err := time.Parse(time.RFC3339, data.To)
+	if err != nil {
+		return model.Query{}, errors.New("invalid to time format")
+	}
+
+	granularity, err := model.ParseGranularity(data.Granularity)
+	if err != nil {
+		return model.Query{}, errors.New("invalid granularity")
+	}
+
+	location, err := model.ParseLocation(data.Timezone)
+	if err != nil {
+		return model.Query{}, errors.New("invalid timezone")
+	}
+
+	fill, err := model.ParseFill(data.Fill)
+	if err != nil {
+		return model.Query{}, errors.New("invalid fill")
+	}
+
+	cursor, err := model.ParseCursor(data.Cursor)
+	if err != nil {
+		return model.Query{}, errors.New("invalid cursor")
+	}
+
+	return model.Query{
+		From:        from,
+		To:          to,
+		Granularity: granularity,
+		Location:    location,
+		Fill:        fill,
+		Limit:       data.Limit,
+		Cursor:      cursor,
+		Unflushed:   data.IncludeUnflushed,
+	}, nil
+}
+
+// Кодирует курсор следующей страницы для ответа. Пустая строка - страница последняя.
+func nextCursor(c *model.Cursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.Encode()
 }
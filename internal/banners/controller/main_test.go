@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+func TestExportFormat(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                      "",
+		"application/json":                      "",
+		"text/csv":                              mimeCSV,
+		"application/x-ndjson":                  mimeNDJSON,
+		"text/csv;q=0":                          "",
+		"text/csv;q=0, */*":                     "",
+		"text/*":                                mimeCSV,
+		"text/*, text/csv;q=0":                  "",
+		"*/*":                                   "",
+		"text/csv, */*":                         mimeCSV,
+		"application/json, text/csv":            "",
+		"text/csv, application/json":            mimeCSV,
+		"text/csv;q=0.5, application/x-ndjson":  mimeNDJSON,
+		"application/json;q=0.1, text/csv;q=.2": mimeCSV,
+		"application/json;q=0, */*;q=0.5":       mimeCSV,
+		"text/csv;q=abc, application/x-ndjson":  mimeNDJSON,
+		"text/html":                             "",
+	} {
+		if got := exportFormat(accept); got != want {
+			t.Errorf("exportFormat(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("", 3*3600))
+	rows := []model.Counter{
+		{ID: 1, TS: ts, V: 5, Impressions: 10, Conversions: 1},
+		{ID: 1, TS: ts.Add(time.Minute), Null: true},
+	}
+
+	export := func(t *testing.T, format string, rows []model.Counter) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		e := newExporter(w, format)
+		for _, c := range rows {
+			if err := e.write(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.close(); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		w := export(t, mimeCSV, rows)
+
+		if got := w.Header().Get("Content-Type"); got != mimeCSV {
+			t.Fatalf("content type %q, want %q", got, mimeCSV)
+		}
+		want := "ts,v,impressions,conversions\n" +
+			"2024-05-01T10:00:00+03:00,5,10,1\n" +
+			"2024-05-01T10:01:00+03:00,,,\n"
+		if got := w.Body.String(); got != want {
+			t.Fatalf("body:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		w := export(t, mimeNDJSON, rows)
+
+		if got := w.Header().Get("Content-Type"); got != mimeNDJSON {
+			t.Fatalf("content type %q, want %q", got, mimeNDJSON)
+		}
+		want := `{"ts":"2024-05-01T10:00:00+03:00","v":5,"impressions":10,"conversions":1}` + "\n" +
+			`{"ts":"2024-05-01T10:01:00+03:00","v":null,"impressions":null,"conversions":null}` + "\n"
+		if got := w.Body.String(); got != want {
+			t.Fatalf("body:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if got := export(t, mimeCSV, nil).Body.String(); got != "ts,v,impressions,conversions\n" {
+			t.Fatalf("body %q, want header row only", got)
+		}
+		if got := export(t, mimeNDJSON, nil).Body.String(); got != "" {
+			t.Fatalf("body %q, want empty", got)
+		}
+	})
+}
+
+// Usecase, запоминающий примененные пакетные инкременты. Остальные методы не вызываются.
+type usecase struct {
+	model.Usecase
+	batches [][]model.Increment
+}
+
+func (u *usecase) IncrementBatch(items []model.Increment) {
+	u.batches = append(u.batches, items)
+}
+
+func TestController_HandleBatch(t *testing.T) {
+	const limit = 3
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		limit       int
+		status      int
+		applied     []model.Increment
+		errors      []model.ItemError
+	}{
+		{
+			name:    "json array",
+			body:    `[{"id": 1, "delta": 5}, {"id": 2, "metric": "impression", "delta": 1}]`,
+			status:  http.StatusOK,
+			applied: []model.Increment{{ID: 1, Metric: model.Click, Delta: 5}, {ID: 2, Metric: model.Impression, Delta: 1}},
+		},
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson; charset=utf-8",
+			body:        "{\"id\": 1, \"delta\": 5}\n\n{\"id\": 2, \"metric\": \"conversion\", \"delta\": 2}\n",
+			status:      http.StatusOK,
+			applied:     []model.Increment{{ID: 1, Metric: model.Click, Delta: 5}, {ID: 2, Metric: model.Conversion, Delta: 2}},
+		},
+		{
+			name:    "invalid items",
+			body:    `[{"id": 1, "delta": 0}, {"id": 2, "delta": 1}, {"id": -1, "delta": 1}, {"id": "x"}]`,
+			limit:   4,
+			status:  http.StatusOK,
+			applied: []model.Increment{{ID: 2, Metric: model.Click, Delta: 1}},
+			errors: []model.ItemError{
+				{Index: 0, Error: "delta must be in range [1, 1000000]"},
+				{Index: 2, Error: "id must not be negative"},
+				{Index: 3, Error: "invalid item"},
+			},
+		},
+		{
+			name:   "too many items",
+			body:   `[{"id": 1, "delta": 1}, {"id": 2, "delta": 1}, {"id": 3, "delta": 1}, {"id": 4, "delta": 1}]`,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "too many ndjson items",
+			contentType: "application/x-ndjson",
+			body:        strings.Repeat("{\"id\": 1, \"delta\": 1}\n", limit+1),
+			status:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "body too large",
+			body:   `[{"id": 1, "delta": 1, "padding": "` + strings.Repeat("x", limit*maxItemSize) + `"}]`,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "ndjson line too long",
+			contentType: "application/x-ndjson",
+			body:        `{"id": 1, "delta": 1, "padding": "` + strings.Repeat("x", 70<<10) + `"}` + "\n",
+			limit:       100,
+			status:      http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "not an array",
+			body:   `{"id": 1, "delta": 1}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "malformed",
+			body:   `[{"id": 1, "delta": 1}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := &usecase{}
+			c := New(uc, cmp.Or(tt.limit, limit))
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/banners/batch", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			c.HandleBatch(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if len(uc.batches) != 0 {
+					t.Fatalf("applied %v on rejected request", uc.batches)
+				}
+				return
+			}
+
+			var response model.IncrementResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if len(uc.batches) != 1 || !slices.Equal(uc.batches[0], tt.applied) || response.Applied != len(tt.applied) {
+				t.Fatalf("applied %v (%d in response), want %v", uc.batches, response.Applied, tt.applied)
+			}
+			if !slices.Equal(response.Errors, tt.errors) {
+				t.Fatalf("errors %v, want %v", response.Errors, tt.errors)
+			}
+		})
+	}
+}
@@ -2,16 +2,26 @@ package banners
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/aaoreshkin/click-counter/internal/banners/controller"
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
 	"github.com/aaoreshkin/click-counter/internal/banners/repository"
 	"github.com/aaoreshkin/click-counter/internal/banners/usecase"
 	"github.com/aaoreshkin/click-counter/internal/provider/database"
-	"github.com/aaoreshkin/click-counter/internal/provider/inmemory"
+	"github.com/aaoreshkin/click-counter/internal/provider/wal"
 )
 
 type (
+	// Параметры модуля баннеров.
+	Config struct {
+		Mode       repository.Mode // Способ записи батчей в БД.
+		Workers    int             // Количество воркеров сброса кэша.
+		Interval   time.Duration   // Интервал между сбросами кэша.
+		BatchLimit int             // Максимальное количество элементов в пакетном инкременте.
+	}
+
 	// Manager управляет жизненным циклом всех компонентов модуля баннеров.
 	// Инкапсулирует создание зависимостей, запуск фоновых воркеров для сброса кэша
 	// и предоставляет доступ к HTTP контроллеру для роутера.
@@ -19,40 +29,84 @@ type (
 		repository *repository.Repository
 		usecase    *usecase.Usecase
 		controller *controller.Controller
+
+		cancel context.CancelFunc // Останавливает периодический сброс кэша.
+		abort  context.CancelFunc // Прерывает текущий периодический сброс.
+		wg     sync.WaitGroup     // Ожидание завершения периодического сброса.
 	}
 )
 
 // Новый экземпляр Manager с полной инициализацией всех компонентов.
-// Запускает указанное количество воркеров для периодического сброса кэша в БД.
-// Воркеры автоматически останавливаются при отмене контекста.
-func New(ctx context.Context, connection *database.Connection, cache *inmemory.Cache, workers int, interval time.Duration) *Manager {
-
-	repository := repository.New(connection)
-	usecase := usecase.New(repository, cache)
-	controller := controller.New(usecase)
-
-	for range workers {
-		go func() {
-			ticker := time.NewTicker(interval)
-
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					usecase.FlushToDB(ctx)
-				}
-			}
-		}()
+// Запускает периодический сброс кэша в БД config.Workers воркерами,
+// каждый из которых владеет своим диапазоном шардов.
+// Перед запуском восстанавливает в кэше данные из журнала (если он включен).
+// Сброс останавливается при отмене контекста или вызове Shutdown.
+func New(ctx context.Context, connection *database.Connection, cache model.Store, wal *wal.Log, config Config) (*Manager, error) {
+
+	repository := repository.New(connection, config.Mode)
+	usecase := usecase.New(repository, cache, wal, config.Workers)
+	controller := controller.New(usecase, config.BatchLimit)
+
+	if err := usecase.Restore(); err != nil {
+		return nil, err
 	}
 
-	return &Manager{
-		repository,
-		usecase,
-		controller,
+	// Остановка новых сбросов и прерывание текущего разделены: Shutdown дает текущему сбросу
+	// завершиться в пределах своего дедлайна, а не обрывает его сразу.
+	done, cancel := context.WithCancel(ctx)
+	flush, abort := context.WithCancel(ctx)
+
+	m := &Manager{
+		repository: repository,
+		usecase:    usecase,
+		controller: controller,
+		cancel:     cancel,
+		abort:      abort,
 	}
+
+	m.wg.Add(1)
+
+	// Тикер не копит тики: если сброс длится дольше интервала, лишние тики пропускаются.
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(config.Interval)
+
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done.Done():
+				return
+			case <-ticker.C:
+				usecase.FlushToDB(flush)
+			}
+		}
+	}()
+
+	return m, nil
+}
+
+// Останавливает периодический сброс и выполняет финальный сброс кэша в БД.
+// Дожидается завершения текущего сброса, чтобы финальный сброс не пересекался с ним.
+// Время остановки, включая текущий сброс, ограничено дедлайном переданного контекста:
+// по дедлайну текущий сброс прерывается, а батчи, запись которых прервана, возвращаются
+// в очередь повторов и достаются финальному сбросу.
+func (m *Manager) Shutdown(ctx context.Context) {
+	m.cancel()
+
+	stop := context.AfterFunc(ctx, m.abort)
+	defer stop()
+
+	m.wg.Wait()
+	m.abort()
+
+	m.usecase.Shutdown(ctx)
+}
+
+// Закрывает live-потоки, чтобы остановка HTTP сервера не ждала долгих запросов.
+func (m *Manager) CloseStreams() {
+	m.usecase.CloseLive()
 }
 
 // Возвращает HTTP контроллер для регистрации роутов.
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Позиция постраничной выдачи: баннер и начало последнего выданного интервала.
+// Клиенту передается в непрозрачном виде (Encode) с контрольной суммой, чтобы измененный курсор отклонялся.
+type Cursor struct {
+	ID int
+	TS time.Time
+}
+
+// Кодирует курсор в непрозрачную строку для клиента.
+func (c Cursor) Encode() string {
+	var buf [20]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(c.ID))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(c.TS.UnixNano()))
+	binary.BigEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:16]))
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// Разбирает курсор, полученный от клиента. Пустая строка означает первую страницу.
+// Курсор с неверной контрольной суммой отклоняется.
+func ParseCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != 20 || binary.BigEndian.Uint32(buf[16:]) != crc32.ChecksumIEEE(buf[:16]) {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+
+	return &Cursor{
+		ID: int(binary.BigEndian.Uint64(buf[:8])),
+		TS: time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16]))).UTC(),
+	}, nil
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	Minute Granularity = "minute"
+	Hour   Granularity = "hour"
+	Day    Granularity = "day"
+	Week   Granularity = "week"
+	Month  Granularity = "month"
+)
+
+// Размер интервала, по которому агрегируется статистика.
+type Granularity string
+
+// Разбирает размер интервала. Пустая строка соответствует минуте.
+func ParseGranularity(s string) (Granularity, error) {
+	switch g := Granularity(s); g {
+	case "":
+		return Minute, nil
+	case Minute, Hour, Day, Week, Month:
+		return g, nil
+	}
+	return "", fmt.Errorf("%w: unknown granularity: %s", ErrInvalidQuery, s)
+}
+
+// Возвращает начало интервала, в который попадает t, в часовом поясе loc.
+// Совпадает с date_trunc(g, t, loc) в PostgreSQL.
+func (g Granularity) Truncate(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+
+	switch g {
+	case Minute:
+		return t.Truncate(time.Minute)
+	case Hour:
+		// Вычитание вместо time.Date: в час перевода часов назад локальное время неоднозначно.
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case Week:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7) // Неделя начинается с понедельника.
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// Возвращает начало интервала, следующего за интервалом, начинающимся в t.
+func (g Granularity) Next(t time.Time) time.Time {
+	return g.Add(t, 1)
+}
+
+// Сдвигает t на n интервалов, при отрицательном n - назад.
+// Дни, недели и месяцы считаются по календарю часового пояса t.
+func (g Granularity) Add(t time.Time, n int) time.Time {
+	switch g {
+	case Minute:
+		return t.Add(time.Duration(n) * time.Minute)
+	case Hour:
+		return t.Add(time.Duration(n) * time.Hour)
+	case Week:
+		return t.AddDate(0, 0, 7*n)
+	case Month:
+		return t.AddDate(0, n, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+// Минимальная длительность интервала, используется для оценки их количества в периоде.
+func (g Granularity) duration() time.Duration {
+	switch g {
+	case Hour:
+		return time.Hour
+	case Day:
+		return 24 * time.Hour
+	case Week:
+		return 7 * 24 * time.Hour
+	case Month:
+		return 28 * 24 * time.Hour
+	}
+	return time.Minute
+}
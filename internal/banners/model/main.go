@@ -2,41 +2,330 @@ package model
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// Максимальное приращение счетчика в одном элементе пакетного инкремента.
+const MaxDelta = 1_000_000
+
+const (
+	// Клик по баннеру. Нулевое значение Metric: запросы без явной метрики считаются кликами.
+	Click Metric = iota
+
+	// Показ баннера.
+	Impression
+
+	// Конверсия после клика.
+	Conversion
+
+	// Количество метрик.
+	Metrics = 3
+)
+
+// Названия метрик в API.
+var metrics = [Metrics]string{"click", "impression", "conversion"}
+
 type (
+	// Тип события, по которому ведется счетчик.
+	Metric uint8
+
+	// Ключ счетчика в кэше: баннер, метрика и минута, в которую произошло событие.
+	// Минута фиксируется в момент события, а не сброса, чтобы медленный или повторный
+	// сброс не переносил события в более поздние минуты.
+	Key struct {
+		ID     int
+		Metric Metric
+		TS     int64 // Начало минуты события, unix секунды.
+	}
+
 	// Представляет агрегированные данные счетчика баннера за определенный период времени.
-	// ID не включается в JSON ответ, TS - временная метка, V - значение счетчика.
+	// ID не включается в JSON ответ, TS - временная метка, V - количество кликов,
+	// Impressions и Conversions - количество показов и конверсий.
+	// Null помечает интервал без данных, значения которого сериализуются как null.
 	Counter struct {
-		ID int       `json:"-"`
-		TS time.Time `json:"ts"`
-		V  int       `json:"v"`
+		ID          int       `json:"-"`
+		TS          time.Time `json:"ts"`
+		V           int       `json:"v"`
+		Impressions int       `json:"impressions"`
+		Conversions int       `json:"conversions"`
+		Null        bool      `json:"-"`
+	}
+
+	// Элемент пакетного инкремента: приращение счетчика баннера.
+	// Metric необязательна, по умолчанию - клик.
+	Increment struct {
+		ID     int    `json:"id"`
+		Metric Metric `json:"metric"`
+		Delta  int64  `json:"delta"`
+	}
+
+	// Ошибка обработки элемента пакетного инкремента.
+	// Index - позиция элемента в запросе.
+	ItemError struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	}
+
+	// Представляет ответ на пакетный инкремент.
+	// Applied - количество примененных элементов, Errors - отклоненные элементы.
+	IncrementResponse struct {
+		Applied int         `json:"applied"`
+		Errors  []ItemError `json:"errors,omitempty"`
+	}
+
+	// Представляет ответ со статистикой по нескольким баннерам, ключ - ID баннера.
+	// NextCursor передается только при постраничной выдаче, если есть следующая страница.
+	// Unflushed - учтены ли данные, еще не сброшенные в БД.
+	MultiStatsResponse struct {
+		Series     map[int]StatsResponse `json:"series"`
+		NextCursor string                `json:"next_cursor,omitempty"`
+		Unflushed  bool                  `json:"unflushed"`
+	}
+
+	// Позиция баннера в топе по кликам.
+	// Баннеры с одинаковым количеством кликов делят место.
+	Top struct {
+		ID    int   `json:"id"`
+		Total int64 `json:"total"`
+		Rank  int   `json:"rank"`
+	}
+
+	// Представляет ответ с топом баннеров по кликам за период.
+	// Unflushed - учтены ли клики, еще не сброшенные в БД.
+	TopResponse struct {
+		Top       []Top `json:"top"`
+		Unflushed bool  `json:"unflushed"`
+	}
+
+	// Сводная статистика кликов баннера за период по интервалам выбранного размера.
+	// Учитываются только активные интервалы (с кликами): Buckets - их количество,
+	// Mean и перцентили считаются по кликам в активных интервалах.
+	// MaxTS - начало интервала с наибольшим количеством кликов, null если кликов не было.
+	Summary struct {
+		Total   int64      `json:"total"`
+		Buckets int64      `json:"buckets"`
+		Mean    float64    `json:"mean"`
+		Max     int64      `json:"max"`
+		MaxTS   *time.Time `json:"max_ts"`
+		P50     float64    `json:"p50"`
+		P90     float64    `json:"p90"`
+		P99     float64    `json:"p99"`
+	}
+
+	// Значения метрик интервала или периода.
+	Values struct {
+		V           int `json:"v"`
+		Impressions int `json:"impressions"`
+		Conversions int `json:"conversions"`
+	}
+
+	// Изменение метрик в процентах относительно периода сравнения.
+	// Значение null, если в периоде сравнения метрика равна 0.
+	Change struct {
+		V           *float64 `json:"v"`
+		Impressions *float64 `json:"impressions"`
+		Conversions *float64 `json:"conversions"`
+	}
+
+	// Разница интервала запрошенного периода с интервалом периода сравнения под тем же номером.
+	// CompareTS равен null, если период сравнения короче и парного интервала нет.
+	Delta struct {
+		TS        time.Time  `json:"ts"`
+		CompareTS *time.Time `json:"compare_ts"`
+		Abs       Values     `json:"abs"`
+		Pct       Change     `json:"pct"`
+	}
+
+	// Итоги запрошенного периода и периода сравнения и разница между ними.
+	Totals struct {
+		Current Values `json:"current"`
+		Compare Values `json:"compare"`
+		Abs     Values `json:"abs"`
+		Pct     Change `json:"pct"`
 	}
 
-	// Представляет запрос на получение статистики с временными границами.
-	// Время передается в строковом формате для удобства JSON сериализации.
-	Stats struct {
-		From string `json:"from"`
-		To   string `json:"to"`
+	// Сравнение статистики с другим периодом: ряд периода сравнения,
+	// разница по интервалам и итоги. Оба ряда заполнены нулями.
+	Comparison struct {
+		From   time.Time `json:"from"`
+		To     time.Time `json:"to"`
+		Stats  []Counter `json:"stats"`
+		Deltas []Delta   `json:"deltas"`
+		Totals Totals    `json:"totals"`
 	}
 
 	// Представляет ответ с массивом статистических данных.
+	// CTR (клики / показы) и CR (конверсии / клики) считаются по итогам за весь период,
+	// при нулевом знаменателе равны 0. При постраничной выдаче они считаются по странице,
+	// а NextCursor передается, если есть следующая страница.
+	// Unflushed - учтены ли данные, еще не сброшенные в БД.
 	StatsResponse struct {
-		Stats []Counter `json:"stats"`
+		Stats      []Counter   `json:"stats"`
+		CTR        float64     `json:"ctr"`
+		CR         float64     `json:"cr"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+		Comparison *Comparison `json:"comparison,omitempty"`
+		Unflushed  bool        `json:"unflushed"`
 	}
 
 	// Определяет интерфейс бизнес-логики для работы со счетчиками баннеров.
 	// Абстрагирует controller от конкретной реализации usecase слоя.
 	Usecase interface {
 		Increment(int)
-		GetStats(context.Context, int, time.Time, time.Time) ([]Counter, error)
+		IncrementBy(int, int64)
+		IncrementMetric(int, Metric, int64)
+		IncrementBatch([]Increment)
+		GetStats(context.Context, Query) ([]Counter, error)
+		GetStatsMulti(context.Context, []int, Query) (map[int][]Counter, error)
+		GetStatsMerged(context.Context, []int, Query) ([]Counter, error)
+		GetTop(context.Context, TopQuery) ([]Top, error)
+		GetSummary(context.Context, Query) (Summary, error)
+		StreamStats(context.Context, Query, func(Counter) error) error
+		GetStatsPage(context.Context, []int, Query) ([]Counter, *Cursor, error)
+		GetStatsCompare(context.Context, Query, Compare) ([]Counter, Comparison, error)
+		Live(int) (<-chan Counter, func())
+	}
+
+	// Store определяет интерфейс write-behind хранилища счетчиков, накапливающего клики до сброса в БД.
+	// Абстрагирует usecase от конкретной реализации кэша.
+	// Хранилище разбито на шарды, каждый из которых вычитывается независимо.
+	Store interface {
+		// Количество шардов.
+		Len() int
+
+		// Номер шарда, в который попадает ключ. Ключи одного баннера лежат в одном шарде (Key.Hash).
+		Shard(Key) int
+
+		// Увеличивает счетчик ключа на delta.
+		Add(Key, int64)
+
+		// Вычитывает шард в пустой буфер и возвращает вычитанные данные,
+		// которые переходят в распоряжение вызывающего.
+		Drain(int, map[Key]int64) map[Key]int64
+
+		// Обходит текущие значения счетчиков без их вычитывания.
+		Range(func(Key, int64))
+
+		// Обходит текущие значения счетчиков одного шарда без их вычитывания.
+		RangeShard(int, func(Key, int64))
 	}
 
 	// Repository определяет интерфейс доступа к данным счетчиков.
 	// Абстрагирует usecase от конкретной реализации хранилища данных.
 	Repository interface {
-		BatchData(context.Context, map[int]int64) error
-		GetStats(context.Context, int, time.Time, time.Time) ([]Counter, error)
+		BatchData(context.Context, map[Key]int64) error
+		GetStats(context.Context, Query) ([]Counter, error)
+		GetStatsMulti(context.Context, []int, Query) ([]Counter, error)
+		GetTop(context.Context, TopQuery) ([]Top, error)
+		GetTotals(context.Context, []int, time.Time, time.Time) (map[int]int64, error)
+		GetSummary(context.Context, Query) (Summary, error)
+		StreamStats(context.Context, Query, func(Counter) error) error
+		GetStatsPage(context.Context, []int, Query) ([]Counter, error)
 	}
 )
+
+// Ключ счетчика метрики баннера для минуты, в которую попадает указанное время.
+func NewKey(id int, metric Metric, t time.Time) Key {
+	ts := t.Unix()
+	return Key{ID: id, Metric: metric, TS: ts - ts%60}
+}
+
+// Возвращает хэш ключа для распределения по шардам кэша.
+// Все минуты одного баннера попадают в один шард.
+func (k Key) Hash() int {
+	return k.ID
+}
+
+// Возвращает начало минуты ключа.
+func (k Key) Time() time.Time {
+	return time.Unix(k.TS, 0).UTC()
+}
+
+// Проверяет корректность элемента пакетного инкремента.
+func (i Increment) Validate() error {
+	if i.ID < 0 {
+		return errors.New("id must not be negative")
+	}
+	if i.Delta <= 0 || i.Delta > MaxDelta {
+		return errors.New("delta must be in range [1, 1000000]")
+	}
+	return nil
+}
+
+// Возвращает название метрики.
+func (m Metric) String() string {
+	if int(m) < len(metrics) {
+		return metrics[m]
+	}
+	return fmt.Sprintf("metric(%d)", m)
+}
+
+// Сериализует метрику в JSON по названию.
+func (m Metric) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Разбирает метрику из названия.
+func (m *Metric) UnmarshalText(text []byte) error {
+	for i, name := range metrics {
+		if string(text) == name {
+			*m = Metric(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown metric: %s", text)
+}
+
+// Добавляет к счетчику значение метрики.
+func (c *Counter) Add(metric Metric, v int) {
+	switch metric {
+	case Click:
+		c.V += v
+	case Impression:
+		c.Impressions += v
+	case Conversion:
+		c.Conversions += v
+	}
+}
+
+// Сериализует счетчик в JSON. Значения интервала без данных (Null) сериализуются как null.
+func (c Counter) MarshalJSON() ([]byte, error) {
+	type counter Counter
+
+	if !c.Null {
+		return json.Marshal(counter(c))
+	}
+
+	return json.Marshal(struct {
+		TS          time.Time `json:"ts"`
+		V           *int      `json:"v"`
+		Impressions *int      `json:"impressions"`
+		Conversions *int      `json:"conversions"`
+	}{TS: c.TS})
+}
+
+// Формирует ответ со статистикой, рассчитывая CTR и CR по итогам за период.
+func NewStatsResponse(stats []Counter) StatsResponse {
+	var total Counter
+	for _, c := range stats {
+		total.V += c.V
+		total.Impressions += c.Impressions
+		total.Conversions += c.Conversions
+	}
+
+	return StatsResponse{
+		Stats: stats,
+		CTR:   ratio(total.V, total.Impressions),
+		CR:    ratio(total.Conversions, total.V),
+	}
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
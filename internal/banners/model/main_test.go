@@ -0,0 +1,193 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	for _, c := range []Cursor{
+		{ID: 1, TS: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{ID: 1 << 40, TS: time.Date(1999, 12, 31, 23, 59, 0, 0, time.FixedZone("", -5*3600))},
+		{ID: 0, TS: time.Unix(0, 0)},
+	} {
+		got, err := ParseCursor(c.Encode())
+		if err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+		if got.ID != c.ID || !got.TS.Equal(c.TS) {
+			t.Fatalf("round trip %+v, want %+v", got, c)
+		}
+	}
+
+	if c, err := ParseCursor(""); c != nil || err != nil {
+		t.Fatalf("empty cursor: %+v, %v", c, err)
+	}
+}
+
+func TestCursor_Tampered(t *testing.T) {
+	s := Cursor{ID: 7, TS: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}.Encode()
+	buf, _ := base64.RawURLEncoding.DecodeString(s)
+
+	flipped := func(i int) string {
+		b := append([]byte(nil), buf...)
+		b[i] ^= 1
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	for name, s := range map[string]string{
+		"id":        flipped(7),
+		"ts":        flipped(15),
+		"checksum":  flipped(19),
+		"truncated": base64.RawURLEncoding.EncodeToString(buf[:16]),
+		"extended":  base64.RawURLEncoding.EncodeToString(append(buf, 0)),
+		"base64":    s[:len(s)-1] + "!",
+	} {
+		if _, err := ParseCursor(s); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: error %v, want ErrInvalidQuery", name, err)
+		}
+	}
+}
+
+func TestQuery_Keyset(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	q := Query{From: from, To: from.Add(24 * time.Hour), Granularity: Hour, Location: time.UTC, Limit: 3}
+
+	t.Run("first page", func(t *testing.T) {
+		id, start := q.Keyset([]int{5, 2, 9})
+		if id != 2 || !start.Equal(from) {
+			t.Fatalf("keyset (%d, %s), want (2, %s)", id, start, from)
+		}
+	})
+
+	t.Run("next bucket", func(t *testing.T) {
+		q := q
+		q.Cursor = &Cursor{ID: 5, TS: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+		id, start := q.Keyset([]int{5, 2, 9})
+		if want := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC); id != 5 || !start.Equal(want) {
+			t.Fatalf("keyset (%d, %s), want (5, %s)", id, start, want)
+		}
+	})
+
+	t.Run("partial first bucket", func(t *testing.T) {
+		// Первый интервал начинается раньше from: следующая страница начинается с from, а не раньше.
+		q := q
+		q.Granularity = Day
+		q.Cursor = &Cursor{ID: 5, TS: time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC)}
+
+		if _, start := q.Keyset([]int{5}); !start.Equal(from) {
+			t.Fatalf("start %s, want %s", start, from)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		// Первый интервал 10:00 неполный, в окно помещаются интервалы 10:00, 11:00 и 12:00.
+		if got, want := q.Window(from), time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC); !got.Equal(want) {
+			t.Fatalf("window %s, want %s", got, want)
+		}
+	})
+}
+
+func TestQuery_ValidatePage_Cursor(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	q := Query{From: from, To: from.Add(time.Hour), Granularity: Hour, Location: time.UTC, Limit: 10}
+
+	for name, tc := range map[string]struct {
+		cursor Cursor
+		valid  bool
+	}{
+		"valid":         {Cursor{ID: 1, TS: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)}, true},
+		"first bucket":  {Cursor{ID: 2, TS: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}, true},
+		"other banner":  {Cursor{ID: 3, TS: from}, false},
+		"before period": {Cursor{ID: 1, TS: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)}, false},
+		"after period":  {Cursor{ID: 1, TS: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}, false},
+	} {
+		q := q
+		q.Cursor = &tc.cursor
+
+		err := q.ValidatePage([]int{1, 2})
+		if tc.valid && err != nil || !tc.valid && !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: error %v", name, err)
+		}
+	}
+}
+
+func TestQuery_Validate_Limits(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	minutes := func(n int) Query {
+		return Query{From: from, To: from.Add(time.Duration(n-1) * time.Minute), Granularity: Minute, Location: time.UTC}
+	}
+	page := func(limit int) Query {
+		q := minutes(1)
+		q.Limit = limit
+		return q
+	}
+	top := func(limit int) TopQuery {
+		return TopQuery{From: from, To: from, Limit: limit}
+	}
+	ids := func(n int) []int {
+		ids := make([]int, n)
+		for i := range ids {
+			ids[i] = i
+		}
+		return ids
+	}
+
+	// Поминутных интервалов на баннер, при которых MaxBanners баннеров дают ровно MaxPoints точек.
+	points := MaxPoints / MaxBanners
+
+	for name, tc := range map[string]struct {
+		err   error
+		valid bool
+	}{
+		"buckets at limit":        {minutes(MaxBuckets).Validate(), true},
+		"buckets over limit":      {minutes(MaxBuckets + 1).Validate(), false},
+		"coarser granularity":     {Query{From: from, To: from.Add(MaxBuckets * time.Minute), Granularity: Hour}.Validate(), true},
+		"from after to":           {Query{From: from, To: from.Add(-time.Minute), Granularity: Minute}.Validate(), false},
+		"no banners":              {minutes(1).ValidateMulti(0, false), false},
+		"banners at limit":        {minutes(1).ValidateMulti(MaxBanners, false), true},
+		"banners over limit":      {minutes(1).ValidateMulti(MaxBanners+1, true), false},
+		"points at limit":         {minutes(points).ValidateMulti(MaxBanners, false), true},
+		"points over limit":       {minutes(points+1).ValidateMulti(MaxBanners, false), false},
+		"points merged":           {minutes(points+1).ValidateMulti(MaxBanners, true), true},
+		"multi buckets over":      {minutes(MaxBuckets+1).ValidateMulti(1, true), false},
+		"page limit zero":         {page(0).ValidatePage(ids(1)), false},
+		"page limit at limit":     {page(MaxPageLimit).ValidatePage(ids(1)), true},
+		"page limit over limit":   {page(MaxPageLimit + 1).ValidatePage(ids(1)), false},
+		"page banners at limit":   {page(1).ValidatePage(ids(MaxBanners)), true},
+		"page banners over limit": {page(1).ValidatePage(ids(MaxBanners + 1)), false},
+		"page buckets unlimited":  {Query{From: from, To: from.AddDate(1, 0, 0), Granularity: Minute, Limit: 1}.ValidatePage(ids(1)), true},
+		"top limit zero":          {top(0).Validate(), false},
+		"top limit at limit":      {top(MaxTopLimit).Validate(), true},
+		"top limit over limit":    {top(MaxTopLimit + 1).Validate(), false},
+	} {
+		if tc.valid && tc.err != nil || !tc.valid && !errors.Is(tc.err, ErrInvalidQuery) {
+			t.Errorf("%s: error %v", name, tc.err)
+		}
+	}
+}
+
+func TestNewStatsResponse_Ratios(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		stats   []Counter
+		ctr, cr float64
+	}{
+		"empty":          {nil, 0, 0},
+		"no impressions": {[]Counter{{TS: ts, V: 4, Conversions: 1}}, 0, 0.25},
+		"no clicks":      {[]Counter{{TS: ts, Impressions: 10, Conversions: 1}}, 0, 0},
+		"period totals": {[]Counter{
+			{TS: ts, V: 1, Impressions: 10},
+			{TS: ts.Add(time.Minute), V: 3, Impressions: 30, Conversions: 1},
+		}, 0.1, 0.25},
+	} {
+		r := NewStatsResponse(tc.stats)
+		if r.CTR != tc.ctr || r.CR != tc.cr {
+			t.Errorf("%s: ctr %v, cr %v, want %v, %v", name, r.CTR, r.CR, tc.ctr, tc.cr)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// Период сравнения задан явно.
+	CompareRange ComparePeriod = ""
+
+	// Предыдущий период той же длины, вплотную к запрошенному.
+	ComparePrevious ComparePeriod = "previous"
+
+	// Тот же период неделю, месяц или год назад.
+	CompareWeek  ComparePeriod = "week"
+	CompareMonth ComparePeriod = "month"
+	CompareYear  ComparePeriod = "year"
+)
+
+const (
+	// Без заполнения: в ответе только интервалы, в которых есть данные.
+	FillNone Fill = ""
+
+	// Интервалы без данных заполняются нулями.
+	FillZero Fill = "zero"
+
+	// Интервалы без данных заполняются null.
+	FillNull Fill = "null"
+)
+
+// Максимальное количество интервалов в ответе статистики.
+// Ограничивает размер ответа: например, поминутная статистика доступна за период до ~69 дней.
+const MaxBuckets = 100_000
+
+// Максимальное количество баннеров в одном запросе статистики.
+const MaxBanners = 500
+
+// Максимальное количество точек (интервалов всех баннеров) в ответе статистики по нескольким баннерам.
+const MaxPoints = 1_000_000
+
+// Максимальный размер страницы статистики (limit).
+const MaxPageLimit = 10_000
+
+// Количество баннеров в топе по умолчанию и максимальное.
+const (
+	DefaultTopLimit = 10
+	MaxTopLimit     = 1000
+)
+
+// Запрос статистики некорректен. Ошибки валидации запроса оборачивают ее.
+var ErrInvalidQuery = errors.New("invalid query")
+
+type (
+	// Способ заполнения интервалов без данных.
+	Fill string
+
+	// Способ выбора периода сравнения.
+	ComparePeriod string
+
+	// Представляет запрос на получение статистики с временными границами.
+	// Время передается в строковом формате для удобства JSON сериализации.
+	// Granularity необязательна, по умолчанию - минута.
+	// Timezone - IANA часовой пояс для границ интервалов, по умолчанию UTC.
+	// Fill - заполнение интервалов без данных: "zero", "null" или пусто (без заполнения).
+	// Limit и Cursor включают постраничную выдачу: Cursor - next_cursor из предыдущей страницы.
+	// CompareTo - период, с которым сравнивается статистика.
+	// IncludeUnflushed - учитывать данные, еще не сброшенные из кэша в БД.
+	Stats struct {
+		From             string     `json:"from"`
+		To               string     `json:"to"`
+		Granularity      string     `json:"granularity"`
+		Timezone         string     `json:"timezone"`
+		Fill             string     `json:"fill"`
+		Limit            int        `json:"limit"`
+		Cursor           string     `json:"cursor"`
+		CompareTo        *CompareTo `json:"compare_to"`
+		IncludeUnflushed bool       `json:"include_unflushed"`
+	}
+
+	// Период сравнения статистики: period ("previous", "week", "month", "year")
+	// или явный период from/to в формате RFC3339.
+	CompareTo struct {
+		Period string `json:"period"`
+		From   string `json:"from"`
+		To     string `json:"to"`
+	}
+
+	// Разобранный период сравнения. From и To используются только при CompareRange.
+	Compare struct {
+		Period ComparePeriod
+		From   time.Time
+		To     time.Time
+	}
+
+	// Представляет запрос статистики по нескольким баннерам.
+	// Параметры периода те же, что в Stats. При Merge ряды баннеров суммируются в один.
+	MultiStats struct {
+		Stats
+		IDs   []int `json:"ids"`
+		Merge bool  `json:"merge"`
+	}
+
+	// Разобранный запрос статистики баннера.
+	// Границы периода включаются, данные агрегируются по интервалам Granularity,
+	// границы которых считаются в часовом поясе Location.
+	Query struct {
+		BannerID    int
+		From        time.Time
+		To          time.Time
+		Granularity Granularity
+		Location    *time.Location
+		Fill        Fill
+		Limit       int     // Размер страницы, 0 - без постраничной выдачи.
+		Cursor      *Cursor // Последний интервал предыдущей страницы, nil - первая страница.
+		Unflushed   bool    // Учитывать данные, еще не сброшенные из кэша в БД.
+	}
+
+	// Параметры запроса топа баннеров по кликам.
+	// Unflushed - учитывать клики, еще не сброшенные из кэша в БД.
+	TopQuery struct {
+		From      time.Time
+		To        time.Time
+		Limit     int
+		Unflushed bool
+	}
+)
+
+// Разбирает способ заполнения интервалов без данных.
+func ParseFill(s string) (Fill, error) {
+	switch f := Fill(s); f {
+	case FillNone, FillZero, FillNull:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: unknown fill: %s", ErrInvalidQuery, s)
+}
+
+// Разбирает период сравнения. Явный период задается from/to без period.
+func ParseCompare(c *CompareTo) (Compare, error) {
+	switch p := ComparePeriod(c.Period); p {
+	case ComparePrevious, CompareWeek, CompareMonth, CompareYear:
+		return Compare{Period: p}, nil
+	case CompareRange:
+		from, err := time.Parse(time.RFC3339, c.From)
+		if err != nil {
+			return Compare{}, fmt.Errorf("%w: invalid compare_to from time format", ErrInvalidQuery)
+		}
+		to, err := time.Parse(time.RFC3339, c.To)
+		if err != nil {
+			return Compare{}, fmt.Errorf("%w: invalid compare_to to time format", ErrInvalidQuery)
+		}
+		return Compare{Period: p, From: from, To: to}, nil
+	}
+	return Compare{}, fmt.Errorf("%w: unknown compare_to period: %s", ErrInvalidQuery, c.Period)
+}
+
+// Разбирает IANA часовой пояс. Пустая строка соответствует UTC.
+// Часовой пояс сервера ("Local") не принимается: он не имеет смысла для клиента.
+func ParseLocation(s string) (*time.Location, error) {
+	if s == "Local" {
+		return nil, fmt.Errorf("%w: unknown timezone: %s", ErrInvalidQuery, s)
+	}
+
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone: %s", ErrInvalidQuery, s)
+	}
+	return loc, nil
+}
+
+// Проверяет корректность запроса статистики.
+// Период не должен содержать больше MaxBuckets интервалов выбранного размера.
+func (q Query) Validate() error {
+	if q.To.Before(q.From) {
+		return fmt.Errorf("%w: from must not be after to", ErrInvalidQuery)
+	}
+	if q.buckets() > MaxBuckets {
+		return fmt.Errorf("%w: too many %s buckets in range, use coarser granularity", ErrInvalidQuery, q.Granularity)
+	}
+	return nil
+}
+
+// Проверяет корректность запроса статистики по n баннерам.
+// Помимо ограничений Validate, количество баннеров ограничено MaxBanners,
+// а точек в раздельных (не merge) рядах - MaxPoints.
+func (q Query) ValidateMulti(n int, merge bool) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	if n == 0 || n > MaxBanners {
+		return fmt.Errorf("%w: number of banners must be in range [1, %d]", ErrInvalidQuery, MaxBanners)
+	}
+	if !merge && q.buckets()*n > MaxPoints {
+		return fmt.Errorf("%w: too many points in response, use coarser granularity or fewer banners", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Проверяет корректность запроса страницы статистики по баннерам ids.
+// Размер ответа ограничен limit, поэтому количество интервалов в периоде не ограничено.
+// Заполнение пропусков не поддерживается: пропуск может приходиться на границу страниц.
+// Курсор должен указывать на один из запрошенных баннеров и интервал периода.
+func (q Query) ValidatePage(ids []int) error {
+	if q.To.Before(q.From) {
+		return fmt.Errorf("%w: from must not be after to", ErrInvalidQuery)
+	}
+	if n := len(ids); n == 0 || n > MaxBanners {
+		return fmt.Errorf("%w: number of banners must be in range [1, %d]", ErrInvalidQuery, MaxBanners)
+	}
+	if q.Limit < 1 || q.Limit > MaxPageLimit {
+		return fmt.Errorf("%w: limit must be in range [1, %d]", ErrInvalidQuery, MaxPageLimit)
+	}
+	if q.Fill != FillNone {
+		return fmt.Errorf("%w: fill is not supported with limit", ErrInvalidQuery)
+	}
+	if q.Unflushed {
+		return fmt.Errorf("%w: include_unflushed is not supported with limit", ErrInvalidQuery)
+	}
+	if c := q.Cursor; c != nil {
+		if !slices.Contains(ids, c.ID) || c.TS.Before(q.Granularity.Truncate(q.From, q.Location)) || c.TS.After(q.To) {
+			return fmt.Errorf("%w: cursor does not match query", ErrInvalidQuery)
+		}
+	}
+	return nil
+}
+
+// Запрошена ли постраничная выдача.
+func (q Query) Paged() bool {
+	return q.Limit != 0 || q.Cursor != nil
+}
+
+// Возвращает позицию (banner_id, ts), с которой начинается страница статистики по баннерам ids.
+// Следующая страница начинается со следующего за курсором интервала, поэтому интервалы не дробятся между страницами.
+func (q Query) Keyset(ids []int) (int, time.Time) {
+	if q.Cursor == nil {
+		return slices.Min(ids), q.From
+	}
+
+	start := q.Granularity.Next(q.Cursor.TS.In(q.Location))
+	if start.Before(q.From) {
+		start = q.From
+	}
+	return q.Cursor.ID, start
+}
+
+// Возвращает конец окна страницы для баннера, выдача которого начинается со start:
+// в [start, Window(start)) помещается ровно q.Limit интервалов, больше страница взять не может.
+// Окно ограничивает чтение строк, поэтому стоимость страницы не зависит от ее номера и длины периода.
+func (q Query) Window(start time.Time) time.Time {
+	return q.Granularity.Add(q.Granularity.Truncate(start, q.Location), q.Limit)
+}
+
+// Проверяет корректность запроса потоковой выгрузки статистики.
+// Выгрузка не накапливается в памяти, поэтому количество интервалов ограничено только при заполнении пропусков.
+func (q Query) ValidateStream() error {
+	if q.Unflushed {
+		return fmt.Errorf("%w: include_unflushed is not supported for export", ErrInvalidQuery)
+	}
+	if q.Fill != FillNone {
+		return q.Validate()
+	}
+	if q.To.Before(q.From) {
+		return fmt.Errorf("%w: from must not be after to", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Проверяет корректность запроса сводной статистики.
+// Интервалы агрегируются в БД и не возвращаются клиенту, поэтому их количество не ограничено.
+func (q Query) ValidateSummary() error {
+	if q.To.Before(q.From) {
+		return fmt.Errorf("%w: from must not be after to", ErrInvalidQuery)
+	}
+	if q.Fill != FillNone {
+		return fmt.Errorf("%w: fill is not supported for summary", ErrInvalidQuery)
+	}
+	if q.Unflushed {
+		return fmt.Errorf("%w: include_unflushed is not supported for summary", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Оценка сверху количества интервалов в периоде.
+func (q Query) buckets() int {
+	return int(q.To.Sub(q.From)/q.Granularity.duration()) + 1
+}
+
+// Проверяет корректность запроса топа баннеров.
+func (q TopQuery) Validate() error {
+	if q.From.After(q.To) {
+		return fmt.Errorf("%w: from must not be after to", ErrInvalidQuery)
+	}
+	if q.Limit < 1 || q.Limit > MaxTopLimit {
+		return fmt.Errorf("%w: limit must be in range [1, %d]", ErrInvalidQuery, MaxTopLimit)
+	}
+	return nil
+}
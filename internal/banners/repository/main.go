@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/aaoreshkin/click-counter/internal/banners/model"
@@ -9,48 +10,107 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
+const (
+	// Отдельный INSERT ... ON CONFLICT на каждый ключ в одном pgx.Batch.
+	ModeBatch Mode = "batch"
+
+	// Один INSERT ... SELECT FROM unnest(...) ON CONFLICT с массивами всех ключей.
+	ModeUnnest Mode = "unnest"
+
+	// COPY во временную таблицу и один INSERT ... SELECT ... ON CONFLICT из нее.
+	ModeCopy Mode = "copy"
+)
+
 type (
+	// Способ записи батча в БД.
+	Mode string
+
+	// Строка таблицы banners_counter: значения всех метрик баннера за минуту.
+	row struct {
+		id int64
+		ts time.Time
+		v  [model.Metrics]int64 // Индекс - model.Metric.
+	}
+
 	// Repository предоставляет доступ к данным счетчиков баннеров в базе данных.
 	Repository struct {
 		connection *database.Connection
+		mode       Mode
 	}
 )
 
-// Новый экземпляр Repository с переданным подключением к БД.
-func New(connection *database.Connection) *Repository {
+// Разбирает способ записи батча из строки. Пустая строка соответствует ModeBatch.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case "":
+		return ModeBatch, nil
+	case ModeBatch, ModeUnnest, ModeCopy:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown batch mode: %s", s)
+}
+
+// Новый экземпляр Repository с переданным подключением к БД и способом записи батчей.
+func New(connection *database.Connection, mode Mode) *Repository {
 
 	return &Repository{
 		connection,
+		mode,
 	}
 }
 
 // Сохраняет батч данных из шардов в БД.
 // Xранения агрегированных данных как в ТЗ по минутам.
-func (r *Repository) BatchData(ctx context.Context, data map[int]int64) error {
+// Минута берется из ключа: она зафиксирована в момент события.
+// Метрики одного баннера за минуту записываются одной строкой в свои колонки.
+// Часы строк отмечаются для пересчета агрегатов в той же транзакции (markDirty).
+func (r *Repository) BatchData(ctx context.Context, data map[model.Key]int64) error {
 	if len(data) == 0 {
 		return nil
 	}
+
+	rows := pivot(data)
+
+	switch r.mode {
+	case ModeUnnest:
+		return r.batchUnnest(ctx, rows)
+	case ModeCopy:
+		return r.batchCopy(ctx, rows)
+	}
+	return r.batchQueue(ctx, rows)
+}
+
+// Записывает батч отдельным запросом на каждую строку.
+// Все запросы отправляются одним pgx.Batch, но сервер разбирает и выполняет каждый из них.
+// Запросы pgx.Batch выполняются в одной неявной транзакции.
+func (r *Repository) batchQueue(ctx context.Context, rows []row) error {
 	const query = `
 	INSERT INTO banners_counter (
 			banner_id,
 			ts,
-			v
+			v,
+			impressions,
+			conversions
 		)
-		VALUES ($1, $2, $3)
+		VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (banner_id, ts)
-		DO UPDATE SET v = banners_counter.v + EXCLUDED.v
+		DO UPDATE SET
+			v = banners_counter.v + EXCLUDED.v,
+			impressions = banners_counter.impressions + EXCLUDED.impressions,
+			conversions = banners_counter.conversions + EXCLUDED.conversions
 	`
 
 	batch := &pgx.Batch{}
 
-	for id, v := range data {
-		batch.Queue(query, id, time.Now().Truncate(time.Minute), v)
+	for _, row := range rows {
+		batch.Queue(query, row.values()...)
 	}
+	batch.Queue(markDirty, hours(rows))
 
 	br := r.connection.SendBatch(ctx, batch)
 	defer br.Close()
 
-	for i := 0; i < len(data); i++ {
+	for i := 0; i < batch.Len(); i++ {
 		if _, err := br.Exec(); err != nil {
 			return err
 		}
@@ -59,30 +119,387 @@ func (r *Repository) BatchData(ctx context.Context, data map[int]int64) error {
 	return nil
 }
 
+// Записывает батч одним запросом: строки передаются массивами колонок.
+// Отметка часов отправляется тем же pgx.Batch и выполняется в той же неявной транзакции.
+func (r *Repository) batchUnnest(ctx context.Context, rows []row) error {
+	const query = `
+	INSERT INTO banners_counter (
+			banner_id,
+			ts,
+			v,
+			impressions,
+			conversions
+		)
+		SELECT * FROM unnest($1::bigint[], $2::timestamptz[], $3::bigint[], $4::bigint[], $5::bigint[])
+		ON CONFLICT (banner_id, ts)
+		DO UPDATE SET
+			v = banners_counter.v + EXCLUDED.v,
+			impressions = banners_counter.impressions + EXCLUDED.impressions,
+			conversions = banners_counter.conversions + EXCLUDED.conversions
+	`
+
+	batch := &pgx.Batch{}
+	batch.Queue(query, columns(rows)...)
+	batch.Queue(markDirty, hours(rows))
+
+	return r.connection.SendBatch(ctx, batch).Close()
+}
+
+// Записывает батч через COPY во временную таблицу с последующим слиянием.
+// Временная таблица живет в сессии соединения и очищается при коммите.
+func (r *Repository) batchCopy(ctx context.Context, rows []row) error {
+	const (
+		stage = `
+		CREATE TEMP TABLE IF NOT EXISTS banners_counter_stage (
+			banner_id bigint,
+			ts timestamptz,
+			v bigint,
+			impressions bigint,
+			conversions bigint
+		) ON COMMIT DELETE ROWS
+		`
+
+		merge = `
+		INSERT INTO banners_counter (
+				banner_id,
+				ts,
+				v,
+				impressions,
+				conversions
+			)
+			SELECT banner_id, ts, v, impressions, conversions FROM banners_counter_stage
+			ON CONFLICT (banner_id, ts)
+			DO UPDATE SET
+				v = banners_counter.v + EXCLUDED.v,
+				impressions = banners_counter.impressions + EXCLUDED.impressions,
+				conversions = banners_counter.conversions + EXCLUDED.conversions
+		`
+	)
+
+	tx, err := r.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, stage); err != nil {
+		return err
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"banners_counter_stage"}, []string{"banner_id", "ts", "v", "impressions", "conversions"}, pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+		return rows[i].values(), nil
+	})); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, merge); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, markDirty, hours(rows)); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Собирает метрики батча в строки таблицы: по одной на баннер и минуту.
+func pivot(data map[model.Key]int64) []row {
+	type minute struct {
+		id int
+		ts int64
+	}
+
+	var (
+		index = make(map[minute]int, len(data))
+		rows  = make([]row, 0, len(data))
+	)
+
+	for key, v := range data {
+		m := minute{key.ID, key.TS}
+
+		i, ok := index[m]
+		if !ok {
+			i = len(rows)
+			index[m] = i
+			rows = append(rows, row{id: int64(key.ID), ts: key.Time()})
+		}
+		rows[i].v[key.Metric] += v
+	}
+	return rows
+}
+
+// Значения строки в порядке колонок banner_id, ts, v, impressions, conversions.
+func (r row) values() []any {
+	return []any{r.id, r.ts, r.v[model.Click], r.v[model.Impression], r.v[model.Conversion]}
+}
+
+// Раскладывает строки на массивы колонок для передачи в unnest.
+func columns(rows []row) []any {
+	var (
+		ids    = make([]int64, len(rows))
+		ts     = make([]time.Time, len(rows))
+		values [model.Metrics][]int64
+	)
+
+	for m := range values {
+		values[m] = make([]int64, len(rows))
+	}
+
+	for i, row := range rows {
+		ids[i] = row.id
+		ts[i] = row.ts
+		for m := range values {
+			values[m][i] = row.v[m]
+		}
+	}
+	return []any{ids, ts, values[model.Click], values[model.Impression], values[model.Conversion]}
+}
+
 // Возвращает статистику по баннеру за указанный период времени.
-// Данные возвращаются отсортированными по времени.
-func (r *Repository) GetStats(ctx context.Context, bannerID int, from, to time.Time) ([]model.Counter, error) {
+// Минутные строки суммируются по интервалам q.Granularity, границы которых считаются
+// в часовом поясе q.Location с учетом перехода на летнее время.
+// Время интервалов возвращается в q.Location. Данные возвращаются отсортированными по времени.
+// Покрытые агрегатами части периода читаются из часовых или дневных агрегатов (см. source).
+func (r *Repository) GetStats(ctx context.Context, q model.Query) ([]model.Counter, error) {
+	return r.GetStatsMulti(ctx, []int{q.BannerID}, q)
+}
+
+// Возвращает статистику по нескольким баннерам одним запросом.
+// Агрегация та же, что в GetStats. Данные отсортированы по баннеру, затем по времени.
+func (r *Repository) GetStatsMulti(ctx context.Context, ids []int, q model.Query) ([]model.Counter, error) {
+	var stats []model.Counter
+
+	err := r.scanStats(ctx, ids, q, func(counter model.Counter) error {
+		stats = append(stats, counter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Возвращает страницу статистики по нескольким баннерам: не больше q.Limit интервалов,
+// начиная с позиции q.Keyset. Агрегация и порядок те же, что в GetStatsMulti.
+// Позиция задается без OFFSET, а строки каждого баннера читаются только в окне q.Window,
+// в которое помещается целая страница: агрегируется не больше q.Limit интервалов на баннер,
+// поэтому стоимость запроса не растет ни с номером страницы, ни с длиной периода.
+func (r *Repository) GetStatsPage(ctx context.Context, ids []int, q model.Query) ([]model.Counter, error) {
 	const query = `
-		SELECT banner_id, ts, v
-		FROM banners_counter
-		WHERE banner_id = $1 AND ts >= $2 AND ts <= $3
-		ORDER BY ts
+		SELECT b.id, s.bucket, s.v, s.impressions, s.conversions
+		FROM unnest($1::bigint[]) AS b(id)
+		CROSS JOIN LATERAL (
+			SELECT
+				date_trunc($4, ts, $5) AS bucket,
+				sum(v)::bigint AS v,
+				sum(impressions)::bigint AS impressions,
+				sum(conversions)::bigint AS conversions
+			FROM %s AS c
+			WHERE c.banner_id = b.id AND ts <= $3
+				AND ts >= CASE WHEN b.id = $6 THEN $7 ELSE $2 END
+				AND ts < CASE WHEN b.id = $6 THEN $9 ELSE $10 END
+			GROUP BY bucket
+		) AS s
+		WHERE b.id >= $6
+		ORDER BY b.id, s.bucket
+		LIMIT $8
 	`
 
-	rows, err := r.connection.Query(ctx, query, bannerID, from, to)
+	id, start := q.Keyset(ids)
+
+	source, args, err := r.source(ctx, q.From, q.To, q.Granularity, q.Location,
+		[]any{ids, q.From, q.To, string(q.Granularity), q.Location.String(), id, start, q.Limit, q.Window(start), q.Window(q.From)})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.connection.Query(ctx, fmt.Sprintf(query, source), args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var stats []model.Counter
+	stats := make([]model.Counter, 0, q.Limit)
 	for rows.Next() {
 		var counter model.Counter
-		if err := rows.Scan(&counter.ID, &counter.TS, &counter.V); err != nil {
+		if err := rows.Scan(&counter.ID, &counter.TS, &counter.V, &counter.Impressions, &counter.Conversions); err != nil {
 			return nil, err
 		}
+		counter.TS = counter.TS.In(q.Location)
 		stats = append(stats, counter)
 	}
 
 	return stats, rows.Err()
 }
+
+// Передает статистику по баннеру в fn по мере чтения из курсора БД, не накапливая ее в памяти.
+// Агрегация и порядок те же, что в GetStats. Ошибка fn прерывает чтение и возвращается.
+func (r *Repository) StreamStats(ctx context.Context, q model.Query, fn func(model.Counter) error) error {
+	return r.scanStats(ctx, []int{q.BannerID}, q, fn)
+}
+
+// Выполняет запрос статистики и передает строки в fn по одной.
+func (r *Repository) scanStats(ctx context.Context, ids []int, q model.Query, fn func(model.Counter) error) error {
+	const query = `
+		SELECT
+			banner_id,
+			date_trunc($4, ts, $5) AS bucket,
+			sum(v)::bigint,
+			sum(impressions)::bigint,
+			sum(conversions)::bigint
+		FROM %s AS c
+		WHERE banner_id = ANY($1) AND ts >= $2 AND ts <= $3
+		GROUP BY banner_id, bucket
+		ORDER BY banner_id, bucket
+	`
+
+	source, args, err := r.source(ctx, q.From, q.To, q.Granularity, q.Location,
+		[]any{ids, q.From, q.To, string(q.Granularity), q.Location.String()})
+	if err != nil {
+		return err
+	}
+
+	rows, err := r.connection.Query(ctx, fmt.Sprintf(query, source), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var counter model.Counter
+		if err := rows.Scan(&counter.ID, &counter.TS, &counter.V, &counter.Impressions, &counter.Conversions); err != nil {
+			return err
+		}
+		counter.TS = counter.TS.In(q.Location)
+
+		if err := fn(counter); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Возвращает сводную статистику кликов баннера за период.
+// Клики агрегируются по интервалам так же, как в GetStats, затем по интервалам считаются
+// сумма, среднее, максимум и перцентили. Интервалы без кликов не учитываются.
+func (r *Repository) GetSummary(ctx context.Context, q model.Query) (model.Summary, error) {
+	const query = `
+		WITH buckets AS (
+			SELECT date_trunc($4, ts, $5) AS bucket, sum(v)::bigint AS v
+			FROM %s AS c
+			WHERE banner_id = $1 AND ts >= $2 AND ts <= $3 AND v > 0
+			GROUP BY bucket
+		)
+		SELECT
+			coalesce(sum(v), 0)::bigint,
+			count(*),
+			coalesce(avg(v), 0)::float8,
+			coalesce(max(v), 0)::bigint,
+			(SELECT bucket FROM buckets ORDER BY v DESC, bucket LIMIT 1),
+			coalesce(percentile_cont(0.5) WITHIN GROUP (ORDER BY v), 0),
+			coalesce(percentile_cont(0.9) WITHIN GROUP (ORDER BY v), 0),
+			coalesce(percentile_cont(0.99) WITHIN GROUP (ORDER BY v), 0)
+		FROM buckets
+	`
+
+	source, args, err := r.source(ctx, q.From, q.To, q.Granularity, q.Location,
+		[]any{q.BannerID, q.From, q.To, string(q.Granularity), q.Location.String()})
+	if err != nil {
+		return model.Summary{}, err
+	}
+
+	var summary model.Summary
+
+	err = r.connection.QueryRow(ctx, fmt.Sprintf(query, source), args...).Scan(
+		&summary.Total,
+		&summary.Buckets,
+		&summary.Mean,
+		&summary.Max,
+		&summary.MaxTS,
+		&summary.P50,
+		&summary.P90,
+		&summary.P99,
+	)
+	if err != nil {
+		return model.Summary{}, err
+	}
+
+	if summary.MaxTS != nil {
+		ts := summary.MaxTS.In(q.Location)
+		summary.MaxTS = &ts
+	}
+	return summary, nil
+}
+
+// Возвращает топ баннеров по кликам за период.
+// Условие v > 0 позволяет использовать частичный индекс idx_banners_counter_v.
+// Места (Rank) не заполняются: их рассчитывает usecase.
+func (r *Repository) GetTop(ctx context.Context, q model.TopQuery) ([]model.Top, error) {
+	const query = `
+		SELECT banner_id, sum(v)::bigint AS total
+		FROM %s AS c
+		WHERE ts >= $1 AND ts <= $2 AND v > 0
+		GROUP BY banner_id
+		ORDER BY total DESC, banner_id
+		LIMIT $3
+	`
+
+	source, args, err := r.source(ctx, q.From, q.To, "", nil, []any{q.From, q.To, q.Limit})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.connection.Query(ctx, fmt.Sprintf(query, source), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var top []model.Top
+	for rows.Next() {
+		var t model.Top
+		if err := rows.Scan(&t.ID, &t.Total); err != nil {
+			return nil, err
+		}
+		top = append(top, t)
+	}
+
+	return top, rows.Err()
+}
+
+// Возвращает суммарное количество кликов за период по указанным баннерам.
+func (r *Repository) GetTotals(ctx context.Context, ids []int, from, to time.Time) (map[int]int64, error) {
+	const query = `
+		SELECT banner_id, sum(v)::bigint
+		FROM %s AS c
+		WHERE banner_id = ANY($1) AND ts >= $2 AND ts <= $3
+		GROUP BY banner_id
+	`
+
+	source, args, err := r.source(ctx, from, to, "", nil, []any{ids, from, to})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.connection.Query(ctx, fmt.Sprintf(query, source), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[int]int64, len(ids))
+	for rows.Next() {
+		var (
+			id    int
+			total int64
+		)
+		if err := rows.Scan(&id, &total); err != nil {
+			return nil, err
+		}
+		totals[id] = total
+	}
+
+	return totals, rows.Err()
+}
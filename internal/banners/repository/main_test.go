@@ -0,0 +1,333 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+	"github.com/aaoreshkin/click-counter/internal/provider/database"
+)
+
+// Диапазон ID баннеров, которые пишут бенчмарки. Удаляются после прогона.
+const benchBannerID = 1 << 40
+
+// Сравнение способов записи батча. Требует DATABASE_URL с примененными миграциями:
+//
+//	DATABASE_URL=... go test -run xxx -bench BatchData ./internal/banners/repository/
+func BenchmarkRepository_BatchData(b *testing.B) {
+	if os.Getenv("DATABASE_URL") == "" {
+		b.Skip("DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer connection.Close()
+
+	defer connection.Exec(ctx, `DELETE FROM banners_counter WHERE banner_id >= $1`, benchBannerID)
+
+	for _, size := range []int{100, 10000} {
+		data := make(map[model.Key]int64, size)
+		for i := range size {
+			data[model.NewKey(benchBannerID+i, model.Click, time.Now())] = 1
+		}
+
+		for _, mode := range []Mode{ModeBatch, ModeUnnest, ModeCopy} {
+			b.Run(string(mode)+"/"+strconv.Itoa(size), func(b *testing.B) {
+				r := New(connection, mode)
+
+				for b.Loop() {
+					if err := r.BatchData(ctx, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Показы и конверсии записываются в свои колонки строки минуты и накапливаются повторной записью
+// так же, как клики, во всех режимах записи. Требует DATABASE_URL с примененными миграциями.
+func TestRepository_BatchData_Metrics(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	defer connection.Exec(ctx, `DELETE FROM banners_counter WHERE banner_id >= $1`, benchBannerID)
+
+	// Час в будущем еще не свернут в агрегаты.
+	from := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+
+	for i, mode := range []Mode{ModeBatch, ModeUnnest, ModeCopy} {
+		t.Run(string(mode), func(t *testing.T) {
+			id := benchBannerID + i
+			r := New(connection, mode)
+
+			data := map[model.Key]int64{
+				model.NewKey(id, model.Click, from):      3,
+				model.NewKey(id, model.Impression, from): 10,
+				model.NewKey(id, model.Conversion, from): 1,
+				// Только показы: строка минуты без кликов.
+				model.NewKey(id, model.Impression, from.Add(time.Minute)): 5,
+			}
+			for range 2 {
+				if err := r.BatchData(ctx, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			q := model.Query{BannerID: id, From: from, To: from.Add(time.Hour), Granularity: model.Minute, Location: time.UTC}
+			stats, err := r.GetStats(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []model.Counter{
+				{ID: id, TS: from, V: 6, Impressions: 20, Conversions: 2},
+				{ID: id, TS: from.Add(time.Minute), Impressions: 10},
+			}
+			if len(stats) != len(want) {
+				t.Fatalf("stats %+v, want %+v", stats, want)
+			}
+			for j := range want {
+				got := stats[j]
+				if !got.TS.Equal(want[j].TS) || got.V != want[j].V || got.Impressions != want[j].Impressions || got.Conversions != want[j].Conversions {
+					t.Fatalf("bucket %d: %+v, want %+v", j, got, want[j])
+				}
+			}
+		})
+	}
+}
+
+// Страницы GetStatsPage в сумме совпадают с GetStatsMulti, в том числе для разреженных рядов,
+// где окно страницы захватывает меньше limit интервалов баннера. Требует DATABASE_URL с примененными миграциями.
+func TestRepository_GetStatsPage(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	defer connection.Exec(ctx, `DELETE FROM banners_counter WHERE banner_id >= $1`, benchBannerID)
+
+	from := time.Now().UTC().Truncate(time.Hour).Add(-24 * time.Hour)
+	ids := []int{benchBannerID, benchBannerID + 1, benchBannerID + 2}
+
+	data := make(map[model.Key]int64)
+	for i := range 24 * 60 {
+		ts := from.Add(time.Duration(i) * time.Minute)
+		data[model.NewKey(ids[0], model.Click, ts)] = 1
+		if i%90 == 0 {
+			data[model.NewKey(ids[2], model.Click, ts)] = int64(i)
+		}
+	}
+
+	r := New(connection, ModeBatch)
+	if err := r.BatchData(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	q := model.Query{From: from, To: from.Add(24 * time.Hour), Granularity: model.Hour, Location: time.UTC}
+
+	want, err := r.GetStatsMulti(ctx, ids, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []model.Counter
+	for q.Limit = 5; ; {
+		page, err := r.GetStatsPage(ctx, ids, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page...)
+		if len(page) < q.Limit {
+			break
+		}
+		last := page[len(page)-1]
+		q.Cursor = &model.Cursor{ID: last.ID, TS: last.TS}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("paged %d buckets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || !got[i].TS.Equal(want[i].TS) || got[i].V != want[i].V {
+			t.Fatalf("bucket %d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// Сводка считается в БД: только интервалы с кликами, перцентили с линейной интерполяцией (percentile_cont).
+// Требует DATABASE_URL с примененными миграциями.
+func TestRepository_GetSummary(t *testing.T) {
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+
+	connection, err := database.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	defer connection.Exec(ctx, `DELETE FROM banners_counter WHERE banner_id >= $1`, benchBannerID)
+
+	// Час в будущем еще не свернут в агрегаты: сводка читает записанные тестом минутные данные.
+	from := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+
+	// Клики по минутам 1..10, третья минута пустая, самая активная - девятая и десятая (по 10).
+	data := make(map[model.Key]int64)
+	for i, v := range []int64{1, 2, 0, 4, 5, 6, 7, 8, 10, 10} {
+		data[model.NewKey(benchBannerID, model.Click, from.Add(time.Duration(i)*time.Minute))] = v
+	}
+	// Другой баннер и другая метрика в сводку не попадают.
+	data[model.NewKey(benchBannerID+1, model.Click, from)] = 100
+	data[model.NewKey(benchBannerID, model.Impression, from.Add(2*time.Minute))] = 100
+
+	r := New(connection, ModeBatch)
+	if err := r.BatchData(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	q := model.Query{BannerID: benchBannerID, From: from, To: from.Add(time.Hour), Granularity: model.Minute, Location: time.UTC}
+
+	t.Run("minute", func(t *testing.T) {
+		summary, err := r.GetSummary(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if summary.Total != 53 || summary.Buckets != 9 || summary.Max != 10 {
+			t.Fatalf("total %d, buckets %d, max %d, want 53, 9, 10", summary.Total, summary.Buckets, summary.Max)
+		}
+		if want := 53.0 / 9; math.Abs(summary.Mean-want) > 1e-9 {
+			t.Fatalf("mean %v, want %v", summary.Mean, want)
+		}
+		// Активные интервалы: 1 2 4 5 6 7 8 10 10.
+		if summary.P50 != 6 || summary.P90 != 10 || summary.P99 != 10 {
+			t.Fatalf("percentiles %v %v %v, want 6 10 10", summary.P50, summary.P90, summary.P99)
+		}
+		if want := from.Add(8 * time.Minute); summary.MaxTS == nil || !summary.MaxTS.Equal(want) {
+			t.Fatalf("max_ts %v, want %v", summary.MaxTS, want)
+		}
+	})
+
+	t.Run("interpolation", func(t *testing.T) {
+		q := q
+		q.To = from.Add(3 * time.Minute)
+
+		// Активные интервалы 1 и 2: медиана и перцентили между ними.
+		summary, err := r.GetSummary(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.P50 != 1.5 || math.Abs(summary.P90-1.9) > 1e-9 || math.Abs(summary.P99-1.99) > 1e-9 {
+			t.Fatalf("percentiles %v %v %v, want 1.5 1.9 1.99", summary.P50, summary.P90, summary.P99)
+		}
+	})
+
+	t.Run("hour", func(t *testing.T) {
+		q := q
+		q.Granularity = model.Hour
+
+		summary, err := r.GetSummary(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.Buckets != 1 || summary.Mean != 53 || summary.P50 != 53 || summary.P99 != 53 {
+			t.Fatalf("summary %+v, want single bucket of 53", summary)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		q := q
+		q.From, q.To = from.Add(2*time.Hour), from.Add(3*time.Hour)
+
+		summary, err := r.GetSummary(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.MaxTS != nil || summary != (model.Summary{}) {
+			t.Fatalf("summary %+v, want zero", summary)
+		}
+	})
+}
+
+// Минутные данные до горизонта хранения удалены: запрос, которому пришлось бы читать их
+// из минутной таблицы, отклоняется, а не возвращает ряд без данных.
+func TestRoute_Horizon(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	moscow := time.FixedZone("MSK", 3*3600)
+
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	// Конец периода входит в запрос: последняя секунда суток.
+	end := func(t time.Time) time.Time {
+		return t.Add(-time.Second)
+	}
+
+	horizon := date(2026, 1, 1)
+	levels := []level{
+		{rollups[0], date(2025, 1, 1), date(2026, 10, 1)},
+		{rollups[1], date(2025, 3, 1), date(2026, 10, 18)},
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		g        model.Granularity
+		loc      *time.Location
+		invalid  bool
+	}{
+		{"daily utc", date(2025, 6, 1), end(date(2025, 7, 1)), model.Day, time.UTC, false},
+		{"daily from hourly", date(2025, 6, 1).Add(-3 * time.Hour).In(moscow), end(date(2025, 7, 1).Add(-3 * time.Hour)).In(moscow), model.Day, moscow, false},
+		{"daily half hour offset", date(2025, 6, 1).In(kolkata), date(2025, 7, 1).In(kolkata), model.Day, kolkata, true},
+		{"hourly half hour offset", date(2025, 6, 1), date(2025, 6, 2), model.Hour, kolkata, true},
+		{"day end", date(2025, 6, 1), date(2025, 7, 1), model.Day, time.UTC, false},
+		{"partial start", date(2025, 6, 1).Add(30 * time.Minute), end(date(2025, 7, 1)), model.Day, time.UTC, true},
+		{"minute", date(2025, 12, 31), date(2026, 1, 2), model.Minute, time.UTC, true},
+		{"before hourly coverage", date(2025, 2, 1).In(moscow), date(2025, 2, 10).In(moscow), model.Day, moscow, true},
+		{"after horizon", date(2026, 2, 1), date(2026, 2, 2), model.Hour, kolkata, false},
+		{"totals", date(2025, 6, 1).Add(time.Minute), date(2025, 6, 2), "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := route(tt.from, tt.to, tt.g, tt.loc, levels, horizon)
+			if got := errors.Is(err, model.ErrInvalidQuery); got != tt.invalid {
+				t.Fatalf("invalid = %v, want %v (err %v)", got, tt.invalid, err)
+			}
+		})
+	}
+
+	// Пока минутные данные не удалялись, запрос читает их без ограничений.
+	if _, err := route(date(2024, 1, 1), date(2024, 1, 2), model.Hour, kolkata, levels, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,214 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Таблица минутных счетчиков.
+const minutes = "banners_counter"
+
+type (
+	// Таблица агрегатов, из которой может читаться статистика.
+	// Агрегаты считает модуль maintenance, интервалы агрегатов - часы или сутки UTC.
+	rollup struct {
+		name  string              // Имя уровня в banners_counter_rollup.
+		table string              // Таблица агрегатов.
+		unit  time.Duration       // Размер интервала агрегатов.
+		grain []model.Granularity // Интервалы статистики, которые складываются из интервалов агрегатов.
+	}
+
+	// Таблица агрегатов с покрытием: она содержит все данные за [from, to).
+	level struct {
+		rollup
+		from, to time.Time
+	}
+
+	// Часть периода запроса [from, to), читаемая из одной таблицы.
+	segment struct {
+		table    string
+		from, to time.Time
+	}
+)
+
+// Отмечает часы строк батча в banners_counter_dirty, чтобы часовые агрегаты пересчитали часы,
+// записанные после их расчета (повторы записи, восстановление из журнала).
+// Выполняется в одной транзакции с записью строк. Часы передаются отсортированными,
+// поэтому параллельные сбросы блокируют отметки в одном порядке.
+const markDirty = `
+	INSERT INTO banners_counter_dirty (name, ts)
+	SELECT 'hourly', unnest($1::timestamptz[])
+	ON CONFLICT DO NOTHING
+`
+
+// Таблицы агрегатов от самой грубой к самой мелкой.
+var rollups = []rollup{
+	{"daily", "banners_counter_daily", 24 * time.Hour, []model.Granularity{model.Day, model.Week, model.Month}},
+	{"hourly", "banners_counter_hourly", time.Hour, []model.Granularity{model.Hour, model.Day, model.Week, model.Month}},
+}
+
+// Возвращает отсортированные часы UTC, в которые попадают строки.
+func hours(rows []row) []time.Time {
+	hours := make([]time.Time, 0, 1)
+	for _, row := range rows {
+		hours = append(hours, row.ts.Truncate(time.Hour))
+	}
+
+	slices.SortFunc(hours, time.Time.Compare)
+	return slices.CompactFunc(hours, time.Time.Equal)
+}
+
+// Возвращает источник строк за период [from, to] с колонками banners_counter: таблицу
+// или подзапрос UNION ALL (см. route). Границы частей добавляются к args и передаются параметрами запроса.
+func (r *Repository) source(ctx context.Context, from, to time.Time, g model.Granularity, loc *time.Location, args []any) (string, []any, error) {
+	levels, horizon, err := r.levels(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	segments, err := route(from, to, g, loc, levels, horizon)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(segments) == 1 && segments[0].table == minutes {
+		return minutes, args, nil
+	}
+
+	parts := make([]string, len(segments))
+	for i, s := range segments {
+		args = append(args, s.from, s.to)
+		parts[i] = fmt.Sprintf(`SELECT banner_id, ts, v, impressions, conversions FROM %s WHERE ts >= $%d AND ts < $%d`, s.table, len(args)-1, len(args))
+	}
+
+	return "(" + strings.Join(parts, " UNION ALL ") + ")", args, nil
+}
+
+// Разбивает период [from, to] на части, читаемые из одной таблицы. Части периода, покрытые агрегатами,
+// читаются из самой грубой подходящей таблицы агрегатов, остальное - из минутной таблицы.
+// Агрегаты подходят, если каждый их интервал целиком попадает в один интервал статистики g
+// в часовом поясе loc. Пустая g означает запрос без разбиения на интервалы: подходят все агрегаты.
+// Минутные данные до horizon удалены по сроку хранения. Поэтому конец периода до horizon дополняется
+// до целого интервала самых мелких подходящих агрегатов: интервал агрегатов лежит в одном интервале
+// статистики, и данные после to попадают только в интервал, которому принадлежит to.
+// Если часть периода до horizon все равно нельзя прочитать из агрегатов (начало периода внутри интервала
+// агрегатов, агрегаты не считались), возвращается ошибка, оборачивающая model.ErrInvalidQuery,
+// а не ряд без этих данных.
+func route(from, to time.Time, g model.Granularity, loc *time.Location, levels []level, horizon time.Time) ([]segment, error) {
+	var candidates []level
+	for _, l := range levels {
+		if g == "" || slices.Contains(l.grain, g) && aligned(loc, from, to, l.unit) {
+			candidates = append(candidates, l)
+		}
+	}
+
+	// Период запроса включает to, а части - полуоткрытые интервалы.
+	end := to.Add(time.Microsecond)
+	if n := len(candidates); n > 0 && end.Before(horizon) {
+		if unit := candidates[n-1].unit; end.Truncate(unit).Before(end) {
+			end = end.Truncate(unit).Add(unit)
+		}
+	}
+
+	segments := plan(from, end, candidates)
+
+	for _, s := range segments {
+		if s.table == minutes && s.from.Before(horizon) {
+			return nil, fmt.Errorf("%w: minute data before %s is deleted by retention, only hour and coarser granularity "+
+				"in a timezone with offset aligned to the rollup interval is available", model.ErrInvalidQuery, horizon.UTC().Format(time.RFC3339))
+		}
+	}
+	return segments, nil
+}
+
+// Возвращает покрытие таблиц агрегатов в порядке rollups и начало хранимых минутных данных
+// (нулевое, если минутные данные по сроку хранения не удалялись).
+// Таблицы, агрегаты которых еще не считались, пропускаются.
+func (r *Repository) levels(ctx context.Context) ([]level, time.Time, error) {
+	const query = `
+		SELECT name, rolled_from, rolled_to FROM banners_counter_rollup
+		UNION ALL
+		SELECT name, horizon, horizon FROM banners_counter_retention
+	`
+
+	rows, err := r.connection.Query(ctx, query)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	coverage := make(map[string][2]time.Time)
+	for rows.Next() {
+		var (
+			name     string
+			from, to time.Time
+		)
+		if err := rows.Scan(&name, &from, &to); err != nil {
+			return nil, time.Time{}, err
+		}
+		coverage[name] = [2]time.Time{from, to}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	levels := make([]level, 0, len(rollups))
+	for _, rollup := range rollups {
+		if c, ok := coverage[rollup.name]; ok {
+			levels = append(levels, level{rollup, c[0], c[1]})
+		}
+	}
+	return levels, coverage[minutes][0], nil
+}
+
+// Разбивает период [from, to) на части: середина, покрытая первой таблицей агрегатов,
+// читается из нее, а края рекурсивно разбиваются по более мелким таблицам.
+func plan(from, to time.Time, levels []level) []segment {
+	if !from.Before(to) {
+		return nil
+	}
+	if len(levels) == 0 {
+		return []segment{{minutes, from, to}}
+	}
+
+	l := levels[0]
+
+	start, end := from.Truncate(l.unit), to.Truncate(l.unit)
+	if start.Before(from) {
+		start = start.Add(l.unit)
+	}
+	if start.Before(l.from) {
+		start = l.from
+	}
+	if end.After(l.to) {
+		end = l.to
+	}
+	if !start.Before(end) {
+		return plan(from, to, levels[1:])
+	}
+
+	segments := plan(from, start, levels[1:])
+	segments = append(segments, segment{l.table, start, end})
+	return append(segments, plan(end, to, levels[1:])...)
+}
+
+// Проверяет, что смещение часового пояса loc от UTC кратно unit на всем периоде [from, to],
+// с учетом перехода на летнее время. Тогда интервалы агрегатов по UTC не пересекают
+// границы часов (для часовых агрегатов) или суток (для дневных) в loc.
+func aligned(loc *time.Location, from, to time.Time, unit time.Duration) bool {
+	for t := from.In(loc); ; {
+		if _, offset := t.Zone(); time.Duration(offset)*time.Second%unit != 0 {
+			return false
+		}
+
+		_, end := t.ZoneBounds()
+		if end.IsZero() || end.After(to) {
+			return true
+		}
+		t = end
+	}
+}
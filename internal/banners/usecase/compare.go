@@ -0,0 +1,139 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Возвращает статистику по баннеру и ее сравнение с периодом c.
+// Оба ряда заполняются нулями и сопоставляются по номеру интервала, поэтому
+// периоды разной длины (месяц с предыдущим месяцем) сопоставляются с начала.
+func (u *Usecase) GetStatsCompare(ctx context.Context, q model.Query, c model.Compare) ([]model.Counter, model.Comparison, error) {
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if q.Fill == model.FillNull {
+		return nil, model.Comparison{}, fmt.Errorf("%w: fill null is not supported with compare_to", model.ErrInvalidQuery)
+	}
+	q.Fill = model.FillZero
+
+	if err := q.Validate(); err != nil {
+		return nil, model.Comparison{}, err
+	}
+
+	cq := compareQuery(q, c)
+	if err := cq.Validate(); err != nil {
+		return nil, model.Comparison{}, err
+	}
+
+	current, err := u.GetStats(ctx, q)
+	if err != nil {
+		return nil, model.Comparison{}, err
+	}
+
+	previous, err := u.GetStats(ctx, cq)
+	if err != nil {
+		return nil, model.Comparison{}, err
+	}
+
+	return current, compare(current, previous, cq), nil
+}
+
+// Возвращает запрос статистики за период сравнения.
+func compareQuery(q model.Query, c model.Compare) model.Query {
+	from, to := q.From.In(q.Location), q.To.In(q.Location)
+
+	switch c.Period {
+	case model.ComparePrevious:
+		// Сдвиг на количество интервалов периода: предыдущий период примыкает к запрошенному
+		// и содержит столько же интервалов.
+		n := 0
+		last := q.Granularity.Truncate(to, q.Location)
+		for ts := q.Granularity.Truncate(from, q.Location); !ts.After(last); ts = q.Granularity.Next(ts) {
+			n++
+		}
+		q.From, q.To = q.Granularity.Add(from, -n), q.Granularity.Add(to, -n)
+	case model.CompareWeek:
+		q.From, q.To = from.AddDate(0, 0, -7), to.AddDate(0, 0, -7)
+	case model.CompareMonth:
+		q.From, q.To = from.AddDate(0, -1, 0), to.AddDate(0, -1, 0)
+	case model.CompareYear:
+		q.From, q.To = from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0)
+	default:
+		q.From, q.To = c.From.In(q.Location), c.To.In(q.Location)
+	}
+
+	return q
+}
+
+// Сопоставляет ряды запрошенного периода и периода сравнения по номеру интервала.
+// Интервалы периода сравнения сверх длины запрошенного учитываются только в итогах.
+func compare(current, previous []model.Counter, cq model.Query) model.Comparison {
+	comparison := model.Comparison{
+		From:   cq.From,
+		To:     cq.To,
+		Stats:  previous,
+		Deltas: make([]model.Delta, len(current)),
+	}
+
+	totals := &comparison.Totals
+
+	for i, c := range current {
+		delta := model.Delta{TS: c.TS}
+
+		var p model.Values
+		if i < len(previous) {
+			ts := previous[i].TS
+			delta.CompareTS = &ts
+			p = values(previous[i])
+		}
+
+		delta.Abs, delta.Pct = diff(values(c), p)
+		comparison.Deltas[i] = delta
+
+		totals.Current = sum(totals.Current, values(c))
+	}
+
+	for _, c := range previous {
+		totals.Compare = sum(totals.Compare, values(c))
+	}
+	totals.Abs, totals.Pct = diff(totals.Current, totals.Compare)
+
+	return comparison
+}
+
+func values(c model.Counter) model.Values {
+	return model.Values{V: c.V, Impressions: c.Impressions, Conversions: c.Conversions}
+}
+
+func sum(a, b model.Values) model.Values {
+	return model.Values{V: a.V + b.V, Impressions: a.Impressions + b.Impressions, Conversions: a.Conversions + b.Conversions}
+}
+
+// Возвращает абсолютную и процентную разницу значений cur относительно prev.
+func diff(cur, prev model.Values) (model.Values, model.Change) {
+	abs := model.Values{
+		V:           cur.V - prev.V,
+		Impressions: cur.Impressions - prev.Impressions,
+		Conversions: cur.Conversions - prev.Conversions,
+	}
+
+	return abs, model.Change{
+		V:           pct(cur.V, prev.V),
+		Impressions: pct(cur.Impressions, prev.Impressions),
+		Conversions: pct(cur.Conversions, prev.Conversions),
+	}
+}
+
+// Изменение в процентах, nil при нулевом prev.
+func pct(cur, prev int) *float64 {
+	if prev == 0 {
+		return nil
+	}
+
+	v := float64(cur-prev) / float64(prev) * 100
+	return &v
+}
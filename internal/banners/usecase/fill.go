@@ -0,0 +1,96 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Потоковое дополнение ряда интервалами без данных.
+// Принимает интервалы из БД по одному в порядке времени и передает дальше,
+// вставляя перед ними недостающие интервалы. Память не зависит от длины ряда.
+type filler struct {
+	q    model.Query
+	next time.Time // Начало следующего ожидаемого интервала.
+	last time.Time // Начало последнего интервала периода.
+	n    int       // Количество переданных интервалов.
+	emit func(model.Counter) error
+}
+
+// Новый экземпляр filler, передающий интервалы в emit.
+func newFiller(q model.Query, emit func(model.Counter) error) *filler {
+	return &filler{
+		q:    q,
+		next: q.Granularity.Truncate(q.From, q.Location),
+		last: q.Granularity.Truncate(q.To, q.Location),
+		emit: emit,
+	}
+}
+
+// Передает интервал из БД, предварительно дополнив ряд интервалами до него.
+func (f *filler) push(c model.Counter) error {
+	if f.q.Fill == model.FillNone {
+		return f.emit(c)
+	}
+
+	if err := f.gaps(c.TS); err != nil {
+		return err
+	}
+	if c.TS.Equal(f.next) {
+		f.next = f.q.Granularity.Next(f.next)
+	}
+	return f.send(c)
+}
+
+// Дополняет ряд интервалами до конца периода.
+func (f *filler) close() error {
+	if f.q.Fill == model.FillNone {
+		return nil
+	}
+	return f.gaps(f.q.Granularity.Next(f.last))
+}
+
+// Передает пустые интервалы периода, начинающиеся раньше until.
+func (f *filler) gaps(until time.Time) error {
+	for ; f.next.Before(until) && !f.next.After(f.last); f.next = f.q.Granularity.Next(f.next) {
+		if err := f.send(model.Counter{ID: f.q.BannerID, TS: f.next, Null: f.q.Fill == model.FillNull}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Передает интервал дальше. Количество интервалов ограничено model.MaxBuckets.
+func (f *filler) send(c model.Counter) error {
+	if f.n++; f.n > model.MaxBuckets {
+		return fmt.Errorf("%w: too many %s buckets in range, use coarser granularity", model.ErrInvalidQuery, f.q.Granularity)
+	}
+	return f.emit(c)
+}
+
+// Дополняет статистику интервалами без данных, чтобы ряд был непрерывным от q.From до q.To.
+// Статистика должна быть отсортирована по времени. Количество интервалов ограничено model.MaxBuckets.
+func fill(stats []model.Counter, q model.Query) ([]model.Counter, error) {
+	if q.Fill == model.FillNone {
+		return stats, nil
+	}
+
+	series := make([]model.Counter, 0, len(stats))
+
+	f := newFiller(q, func(c model.Counter) error {
+		series = append(series, c)
+		return nil
+	})
+
+	for _, c := range stats {
+		if err := f.push(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.close(); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
@@ -0,0 +1,222 @@
+package usecase
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Интервал опроса кэша и БД для live-потоков.
+const liveInterval = time.Second
+
+type (
+	// Общая рассылка текущих значений счетчиков подписчикам live-потоков.
+	// Один опрос кэша и один запрос к БД за тик обслуживают всех подписчиков всех баннеров.
+	// Опрос запущен, только пока есть подписчики.
+	hub struct {
+		mu      sync.Mutex
+		subs    map[int]map[chan model.Counter]struct{} // подписчики по ID баннера
+		last    map[int]model.Counter                   // последнее разосланное значение по ID баннера
+		running bool                                    // запущен ли опрос
+		closed  bool                                    // рассылка остановлена, новые подписки не принимаются
+
+		// Источник тиков опроса и часы текущей минуты. Тесты подменяют их, чтобы управлять опросом без ожидания.
+		tick func() (<-chan time.Time, func())
+		now  func() time.Time
+	}
+)
+
+// Новый экземпляр hub с опросом раз в liveInterval по системным часам.
+func newHub() hub {
+	return hub{
+		tick: func() (<-chan time.Time, func()) {
+			ticker := time.NewTicker(liveInterval)
+			return ticker.C, ticker.Stop
+		},
+		now: time.Now,
+	}
+}
+
+// Подписывает на значения счетчиков баннера за текущую минуту: в кэше плюс уже сброшенные в БД.
+// Значение приходит при изменении, медленный подписчик получает только последнее.
+// Канал закрывается вызовом возвращенной функции отписки или остановкой рассылки (CloseLive).
+func (u *Usecase) Live(id int) (<-chan model.Counter, func()) {
+	h := &u.live
+	ch := make(chan model.Counter, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if h.subs == nil {
+		h.subs = make(map[int]map[chan model.Counter]struct{})
+		h.last = make(map[int]model.Counter)
+	}
+	if h.subs[id] == nil {
+		h.subs[id] = make(map[chan model.Counter]struct{})
+	}
+	h.subs[id][ch] = struct{}{}
+
+	// Новый подписчик сразу получает последнее известное значение.
+	if c, ok := h.last[id]; ok {
+		ch <- c
+	}
+
+	if !h.running {
+		h.running = true
+		go u.runLive()
+	}
+
+	return ch, func() { h.unsubscribe(id, ch) }
+}
+
+// Останавливает рассылку и закрывает каналы всех подписчиков.
+// Вызывается при остановке сервера, чтобы долгие live-запросы не задерживали ее.
+func (u *Usecase) CloseLive() {
+	h := &u.live
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for id, subs := range h.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(h.subs, id)
+	}
+}
+
+// Отписывает канал ch от баннера id и закрывает его, если он еще не закрыт.
+func (h *hub) unsubscribe(id int, ch chan model.Counter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[id][ch]; !ok {
+		return
+	}
+
+	close(ch)
+	delete(h.subs[id], ch)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+		delete(h.last, id)
+	}
+}
+
+// Возвращает баннеры, на которые есть подписчики.
+// Если подписчиков нет, помечает опрос остановленным: следующая подписка запустит его заново.
+func (h *hub) ids() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subs) == 0 {
+		h.running = false
+		return nil
+	}
+
+	ids := make([]int, 0, len(h.subs))
+	for id := range h.subs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Рассылает значения подписчикам баннеров, значения которых изменились.
+// Отправка не блокируется: непрочитанное значение заменяется новым.
+func (h *hub) publish(counters map[int]model.Counter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, c := range counters {
+		subs, ok := h.subs[id]
+		if !ok {
+			continue
+		}
+
+		// В пределах минуты счетчики только растут. Меньшее значение означает, что данные
+		// вычитаны из кэша, но еще не записаны в БД: такое значение не рассылается.
+		if last, ok := h.last[id]; ok && last.TS.Equal(c.TS) {
+			c.V = max(c.V, last.V)
+			c.Impressions = max(c.Impressions, last.Impressions)
+			c.Conversions = max(c.Conversions, last.Conversions)
+
+			if c.V == last.V && c.Impressions == last.Impressions && c.Conversions == last.Conversions {
+				continue
+			}
+		}
+		h.last[id] = c
+
+		for ch := range subs {
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- c
+		}
+	}
+}
+
+// Опрашивает кэш и БД, пока есть подписчики.
+func (u *Usecase) runLive() {
+	ticks, stop := u.live.tick()
+	defer stop()
+
+	for range ticks {
+		ids := u.live.ids()
+		if ids == nil {
+			return
+		}
+
+		counters, err := u.current(ids)
+		if err != nil {
+			log.Printf("Failed to get live counters: %v", err)
+			continue
+		}
+		u.live.publish(counters)
+	}
+}
+
+// Возвращает значения счетчиков баннеров ids за текущую минуту: сброшенные в БД плюс несброшенные.
+func (u *Usecase) current(ids []int) (map[int]model.Counter, error) {
+	minute := u.live.now().UTC().Truncate(time.Minute)
+
+	counters := make(map[int]model.Counter, len(ids))
+	for _, id := range ids {
+		counters[id] = model.Counter{ID: id, TS: minute}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), liveInterval)
+	defer cancel()
+
+	stats, err := u.repository.GetStatsMulti(ctx, ids, model.Query{
+		From:        minute,
+		To:          minute,
+		Granularity: model.Minute,
+		Location:    time.UTC,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range stats {
+		counters[c.ID] = c
+	}
+
+	u.unflushedOf(ids, func(key model.Key, v int64) {
+		c, ok := counters[key.ID]
+		if !ok || key.TS != minute.Unix() {
+			return
+		}
+		c.Add(key.Metric, int(v))
+		counters[key.ID] = c
+	})
+
+	return counters, nil
+}
@@ -2,69 +2,403 @@ package usecase
 
 import (
 	"context"
+	"log"
 	"maps"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aaoreshkin/click-counter/internal/banners/model"
-	"github.com/aaoreshkin/click-counter/internal/provider/inmemory"
+	"github.com/aaoreshkin/click-counter/internal/provider/wal"
 )
 
 type (
 	// Слой бизнес-логики для работы со счетчиками баннеров.
 	Usecase struct {
 		repository model.Repository
-		cache      *inmemory.Cache
-		buffer     map[int]int64 // переиспользуемый буфер
+		cache      model.Store
+		wal        *wal.Log    // журнал упреждающей записи, nil если отключен
+		walFailed  atomic.Bool // последняя запись в журнал завершилась ошибкой
+		flushers   []*flusher  // воркеры сброса, каждый владеет своим диапазоном шардов
+		retry      retryQueue  // батчи, ожидающие повторной записи
+		mu         sync.Mutex  // сбросы не пересекаются между собой
+		live       hub         // рассылка live-потоков
+
+		// Эпоха журнала: запись в кэш и журнал идет под RLock, смена сегмента и вычитывание кэша - под Lock.
+		// Так клик попадает в БД с тем же сбросом, что удаляет сегмент с его записью.
+		epoch sync.RWMutex
+	}
+
+	// Воркер сброса, владеющий диапазоном шардов [lo, hi) кэша.
+	// Диапазоны воркеров не пересекаются, поэтому собственные буферы не требуют синхронизации.
+	flusher struct {
+		lo, hi  int
+		buffers []map[model.Key]int64 // переиспользуемые буферы, по одному на шард
 	}
 )
 
 // Новый экземпляр Usecase.
-func New(repository model.Repository, cache *inmemory.Cache) *Usecase {
+// Шарды кэша делятся между workers воркерами сброса поровну.
+// Журнал wal опционален: при nil данные кэша не переживают аварийную остановку.
+func New(repository model.Repository, cache model.Store, wal *wal.Log, workers int) *Usecase {
+	workers = max(1, min(workers, cache.Len()))
+
+	flushers := make([]*flusher, workers)
+	for i := range flushers {
+		lo, hi := i*cache.Len()/workers, (i+1)*cache.Len()/workers
+
+		flushers[i] = &flusher{
+			lo:      lo,
+			hi:      hi,
+			buffers: make([]map[model.Key]int64, hi-lo),
+		}
+		for j := range flushers[i].buffers {
+			flushers[i].buffers[j] = make(map[model.Key]int64)
+		}
+	}
+
 	return &Usecase{
 		repository: repository,
 		cache:      cache,
-		buffer:     make(map[int]int64),
+		wal:        wal,
+		flushers:   flushers,
+		retry:      retryQueue{now: time.Now},
+		live:       newHub(),
 	}
 }
 
-// Увеличивает счетчик баннера на 1.
-// Операция потокобезопасная благодаря шардированному кэшу с мьютексами.
+// Восстанавливает в кэше данные из журнала, не подтвержденные БД до остановки.
+// Вызывается при старте до запуска воркеров сброса.
+func (u *Usecase) Restore() error {
+	if u.wal == nil {
+		return nil
+	}
+
+	return u.wal.Replay(func(r wal.Record) {
+		u.cache.Add(model.Key{ID: int(r.ID), Metric: model.Metric(r.Metric), TS: r.TS}, r.Delta)
+	})
+}
+
+// Увеличивает счетчик баннера на 1 в минуте, в которую произошел клик.
+// Операция потокобезопасная благодаря шардированному кэшу.
+// При включенном журнале возвращает управление после записи клика в журнал.
 func (u *Usecase) Increment(id int) {
-	sh := u.cache.GetShard(id)
+	u.IncrementBy(id, 1)
+}
+
+// Увеличивает счетчик кликов баннера на delta в текущей минуте.
+// Delta должна быть положительной.
+func (u *Usecase) IncrementBy(id int, delta int64) {
+	u.IncrementMetric(id, model.Click, delta)
+}
+
+// Увеличивает счетчик метрики баннера на delta в текущей минуте.
+// Delta должна быть положительной.
+func (u *Usecase) IncrementMetric(id int, metric model.Metric, delta int64) {
+	key := model.NewKey(id, metric, time.Now())
+
+	if u.wal == nil {
+		u.cache.Add(key, delta)
+		return
+	}
+
+	// Клик и его запись в журнале принадлежат одной эпохе (см. Usecase.epoch).
+	u.epoch.RLock()
+	defer u.epoch.RUnlock()
+
+	u.cache.Add(key, delta)
+
+	u.appended(u.wal.Append(wal.Record{ID: int64(key.ID), Metric: uint8(key.Metric), TS: key.TS, Delta: delta}))
+}
+
+// Применяет пакет приращений за один проход.
+// Все элементы попадают в текущую минуту, а в журнал пишутся одной группой с одним fsync.
+// Элементы должны быть предварительно проверены через Increment.Validate.
+func (u *Usecase) IncrementBatch(items []model.Increment) {
+	now := time.Now()
+
+	if u.wal != nil {
+		// Пакет и его записи в журнале принадлежат одной эпохе, как в IncrementMetric.
+		u.epoch.RLock()
+		defer u.epoch.RUnlock()
+	}
+
+	for _, item := range items {
+		u.cache.Add(model.NewKey(item.ID, item.Metric, now), item.Delta)
+	}
 
-	sh.Mu.Lock()
-	defer sh.Mu.Unlock()
+	if u.wal == nil || len(items) == 0 {
+		return
+	}
+
+	records := make([]wal.Record, len(items))
+	for i, item := range items {
+		key := model.NewKey(item.ID, item.Metric, now)
+		records[i] = wal.Record{ID: int64(key.ID), Metric: uint8(key.Metric), TS: key.TS, Delta: item.Delta}
+	}
 
-	sh.Data[id]++
+	u.appended(u.wal.Append(records...))
+}
+
+// Пишет в лог смену состояния журнала, а не каждую ошибку записи:
+// при отказе диска ошибка повторялась бы на каждый клик.
+func (u *Usecase) appended(err error) {
+	if err != nil {
+		if !u.walFailed.Load() && !u.walFailed.Swap(true) {
+			log.Printf("Failed to append to wal: %v (further errors are not logged until it recovers)", err)
+		}
+		return
+	}
+	if u.walFailed.Load() && u.walFailed.Swap(false) {
+		log.Printf("WAL append recovered")
+	}
 }
 
 // Сбрасывает все накопленные в кэше данные в базу данных батчами.
 // Операция атомарна для каждого шарда.
+// Если предыдущий сброс еще выполняется, вызов пропускается: данные уйдут следующим сбросом.
 func (u *Usecase) FlushToDB(ctx context.Context) {
-	// Каждый шард обрабатывается независимо
-	for _, sh := range u.cache.Shards {
-		sh.Mu.Lock()
+	if !u.mu.TryLock() {
+		return
+	}
+	defer u.mu.Unlock()
+
+	u.flush(ctx)
+}
+
+// Финальный сброс при остановке сервиса.
+// Дожидается текущего сброса, сбрасывает кэш и делает последнюю попытку записать все батчи
+// из очереди повторов без ожидания задержки, в том числе не записанные самим финальным сбросом.
+// Незаписанные батчи остаются в журнале, а при его отсутствии выгружаются в лог.
+func (u *Usecase) Shutdown(ctx context.Context) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	sealed := u.flush(ctx)
+	u.retryFailed(ctx, true)
+	u.release(sealed)
+}
 
-		// Очищаем переиспользуемый буфер
-		for k := range u.buffer {
-			delete(u.buffer, k)
+// Выполняет сброс: воркеры параллельно вычитывают свои шарды и пишут их в БД.
+// Батчи, которые не удалось записать, ставятся в очередь повторных попыток.
+// Сегменты журнала удаляются, только когда все данные из них подтверждены БД.
+// Возвращает номер запечатанного сегмента журнала (0, если сегмент не запечатан).
+// Вызывается под u.mu.
+func (u *Usecase) flush(ctx context.Context) uint64 {
+	var sealed uint64
+
+	// Смена сегмента и вычитывание кэша - одна эпоха: в запечатанном сегменте ровно те клики,
+	// что вычитаны из кэша. Вычитывание идет в памяти, запись в БД - уже после снятия блокировки.
+	if u.wal != nil {
+		u.epoch.Lock()
+
+		var err error
+		if sealed, err = u.wal.Rotate(); err != nil {
+			log.Printf("Failed to rotate wal: %v", err)
+			sealed = 0
 		}
+	}
+
+	u.parallel(func(f *flusher) { u.collect(f) })
+
+	if u.wal != nil {
+		u.epoch.Unlock()
+	}
+
+	u.retryFailed(ctx, false)
+
+	u.parallel(func(f *flusher) { u.write(ctx, f) })
+
+	u.release(sealed)
+	return sealed
+}
+
+// Удаляет сегменты журнала до sealed включительно, если очередь повторов пуста:
+// иначе в сегментах могут быть данные батчей, еще не подтвержденных БД.
+func (u *Usecase) release(sealed uint64) {
+	if u.wal == nil || sealed == 0 || u.retry.len() > 0 {
+		return
+	}
+	if err := u.wal.Release(sealed); err != nil {
+		log.Printf("Failed to release wal segments: %v", err)
+	}
+}
 
-		maps.Copy(u.buffer, sh.Data)
+// Запускает fn для каждого воркера параллельно и дожидается завершения.
+func (u *Usecase) parallel(fn func(*flusher)) {
+	var wg sync.WaitGroup
 
-		sh.Data = make(map[int]int64) // После сброса кэш очищается.
-		sh.Mu.Unlock()
+	for _, f := range u.flushers {
+		wg.Add(1)
 
-		if len(u.buffer) == 0 {
+		go func() {
+			defer wg.Done()
+			fn(f)
+		}()
+	}
+	wg.Wait()
+}
+
+// Вычитывает шарды воркера в его буферы. После вычитывания шард в кэше пуст.
+func (u *Usecase) collect(f *flusher) {
+	for i := f.lo; i < f.hi; i++ {
+		f.buffers[i-f.lo] = u.cache.Drain(i, f.buffers[i-f.lo])
+	}
+}
+
+// Пишет вычитанные буферы воркера в БД по батчу на шард и очищает их.
+// Буферы переиспользуются между сбросами, поэтому сброс не аллоцирует память.
+func (u *Usecase) write(ctx context.Context, f *flusher) {
+	for _, buffer := range f.buffers {
+		if len(buffer) == 0 {
 			continue
 		}
 		// Ошибка в одном батче не останавливает другие
-		u.repository.BatchData(ctx, u.buffer)
+		if err := u.repository.BatchData(ctx, buffer); err != nil {
+			u.retry.push(&pending{data: maps.Clone(buffer), attempts: 1})
+		}
+		clear(buffer)
 	}
 }
 
-// Возвращает статистику по баннеру за указанный период времени.
+// Возвращает статистику по баннеру за указанный период времени с агрегацией по интервалам.
+// При q.Fill интервалы без данных дополняются нулями или null.
+// При q.Unflushed на данные БД накладываются данные, еще не сброшенные из кэша.
+// Некорректный запрос возвращает ошибку, оборачивающую model.ErrInvalidQuery.
 // Пример запроса в Readme.
-func (u *Usecase) GetStats(ctx context.Context, bannerID int, from, to time.Time) ([]model.Counter, error) {
-	return u.repository.GetStats(ctx, bannerID, from, to)
+func (u *Usecase) GetStats(ctx context.Context, q model.Query) ([]model.Counter, error) {
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	stats, err := u.repository.GetStats(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Unflushed {
+		stats = u.overlay(stats, []int{q.BannerID}, q)
+	}
+	return fill(stats, q)
+}
+
+// Возвращает страницу статистики по баннерам ids размером не больше q.Limit интервалов
+// и курсор следующей страницы (nil, если страница последняя).
+// Страницы упорядочены по баннеру, затем по времени; баннеры без данных в выдачу не попадают.
+func (u *Usecase) GetStatsPage(ctx context.Context, ids []int, q model.Query) ([]model.Counter, *model.Cursor, error) {
+	ids = unique(ids)
+
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.ValidatePage(ids); err != nil {
+		return nil, nil, err
+	}
+
+	// Лишний интервал показывает, есть ли следующая страница, без отдельного запроса.
+	q.Limit++
+
+	stats, err := u.repository.GetStatsPage(ctx, ids, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stats) < q.Limit {
+		return stats, nil, nil
+	}
+
+	stats = stats[:q.Limit-1]
+	last := stats[len(stats)-1]
+	return stats, &model.Cursor{ID: last.ID, TS: last.TS}, nil
+}
+
+// Передает статистику по баннеру в fn по мере чтения из БД, не накапливая ее в памяти.
+// Параметры те же, что у GetStats, но без fill количество интервалов не ограничено.
+// Ошибка fn прерывает выгрузку и возвращается.
+func (u *Usecase) StreamStats(ctx context.Context, q model.Query, fn func(model.Counter) error) error {
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.ValidateStream(); err != nil {
+		return err
+	}
+
+	f := newFiller(q, fn)
+	if err := u.repository.StreamStats(ctx, q, f.push); err != nil {
+		return err
+	}
+	return f.close()
+}
+
+// Возвращает сводную статистику кликов баннера за период.
+// Размер интервала задает q.Granularity: по умолчанию перцентили считаются по минутам.
+func (u *Usecase) GetSummary(ctx context.Context, q model.Query) (model.Summary, error) {
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.ValidateSummary(); err != nil {
+		return model.Summary{}, err
+	}
+
+	return u.repository.GetSummary(ctx, q)
+}
+
+// Возвращает статистику по нескольким баннерам одним запросом к БД, ряды раздельно по ID баннера.
+// В ответе есть все запрошенные баннеры, в том числе без данных.
+func (u *Usecase) GetStatsMulti(ctx context.Context, ids []int, q model.Query) (map[int][]model.Counter, error) {
+	ids = unique(ids)
+
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.ValidateMulti(len(ids), false); err != nil {
+		return nil, err
+	}
+
+	stats, err := u.repository.GetStatsMulti(ctx, ids, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Unflushed {
+		stats = u.overlay(stats, ids, q)
+	}
+
+	// Баннер без данных получает пустой ряд, а не nil: в ответе это [], а не null.
+	series := make(map[int][]model.Counter, len(ids))
+	for _, id := range ids {
+		series[id] = []model.Counter{}
+	}
+	for _, c := range stats {
+		series[c.ID] = append(series[c.ID], c)
+	}
+
+	for _, id := range ids {
+		q.BannerID = id
+		if series[id], err = fill(series[id], q); err != nil {
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+// Возвращает суммарную статистику по нескольким баннерам одним рядом.
+func (u *Usecase) GetStatsMerged(ctx context.Context, ids []int, q model.Query) ([]model.Counter, error) {
+	ids = unique(ids)
+
+	if q.Location == nil {
+		q.Location = time.UTC
+	}
+	if err := q.ValidateMulti(len(ids), true); err != nil {
+		return nil, err
+	}
+
+	stats, err := u.repository.GetStatsMulti(ctx, ids, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Unflushed {
+		stats = u.overlay(stats, ids, q)
+	}
+	return fill(merge(stats), q)
 }
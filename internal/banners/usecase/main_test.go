@@ -0,0 +1,914 @@
+package usecase
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+	"github.com/aaoreshkin/click-counter/internal/provider/inmemory"
+	"github.com/aaoreshkin/click-counter/internal/provider/wal"
+)
+
+// Репозиторий в памяти, суммирующий все записанные батчи.
+type repository struct {
+	mu   sync.Mutex
+	data map[model.Key]int64
+	err  error // Ошибка записи батчей.
+
+	writes int // Количество попыток записи батчей.
+
+	summaries int // Количество запросов сводки.
+}
+
+func (r *repository) BatchData(_ context.Context, data map[model.Key]int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writes++
+	if r.err != nil {
+		return r.err
+	}
+	for k, v := range data {
+		r.data[k] += v
+	}
+	return nil
+}
+
+func (r *repository) GetStats(context.Context, model.Query) ([]model.Counter, error) {
+	return nil, nil
+}
+
+func (r *repository) GetStatsMulti(context.Context, []int, model.Query) ([]model.Counter, error) {
+	return nil, nil
+}
+
+func (r *repository) GetStatsPage(context.Context, []int, model.Query) ([]model.Counter, error) {
+	return nil, nil
+}
+
+func (r *repository) StreamStats(context.Context, model.Query, func(model.Counter) error) error {
+	return nil
+}
+
+// Сводка считается в БД и проверяется тестами репозитория, здесь только считаются запросы.
+func (r *repository) GetSummary(context.Context, model.Query) (model.Summary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.summaries++
+	return model.Summary{}, nil
+}
+
+func (r *repository) GetTop(_ context.Context, q model.TopQuery) ([]model.Top, error) {
+	totals, _ := r.GetTotals(context.Background(), nil, q.From, q.To)
+
+	var top []model.Top
+	for id, total := range totals {
+		top = append(top, model.Top{ID: id, Total: total})
+	}
+	slices.SortFunc(top, func(a, b model.Top) int {
+		return cmp.Or(cmp.Compare(b.Total, a.Total), cmp.Compare(a.ID, b.ID))
+	})
+	return top[:min(len(top), q.Limit)], nil
+}
+
+// Итоги кликов за период. При пустом ids возвращает итоги по всем баннерам.
+func (r *repository) GetTotals(_ context.Context, ids []int, from, to time.Time) (map[int]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	totals := make(map[int]int64)
+	for k, v := range r.data {
+		if k.Metric != model.Click || k.Time().Before(from) || k.Time().After(to) {
+			continue
+		}
+		if len(ids) == 0 || slices.Contains(ids, k.ID) {
+			totals[k.ID] += v
+		}
+	}
+	return totals, nil
+}
+
+func TestUsecase_FlushToDB_Parallel(t *testing.T) {
+	t.Run("mutex", func(t *testing.T) {
+		testFlushParallel(t, inmemory.New(runtime.NumCPU()*2, model.Key.Hash))
+	})
+	t.Run("atomic", func(t *testing.T) {
+		testFlushParallel(t, inmemory.NewAtomic(runtime.NumCPU()*2, model.Key.Hash))
+	})
+}
+
+func testFlushParallel(t *testing.T, cache model.Store) {
+	repo := &repository{data: make(map[model.Key]int64)}
+	u := New(repo, cache, nil, 4)
+
+	const (
+		writers = 8
+		clicks  = 10000
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var flushers sync.WaitGroup
+	for range 4 {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			for ctx.Err() == nil {
+				u.FlushToDB(ctx)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range clicks {
+				u.Increment(w*clicks + i%100)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cancel()
+	flushers.Wait()
+	u.Shutdown(context.Background())
+
+	var total int64
+	for _, v := range repo.data {
+		total += v
+	}
+	if total != writers*clicks {
+		t.Fatalf("flushed %d clicks, want %d", total, writers*clicks)
+	}
+}
+
+// Сумма всех записанных в репозиторий значений.
+func (r *repository) total() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var total int64
+	for _, v := range r.data {
+		total += v
+	}
+	return total
+}
+
+func TestUsecase_WAL_RestoreRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() *wal.Log {
+		l, err := wal.New(dir, wal.SyncBatch, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	restore := func(repo *repository) (*Usecase, *wal.Log) {
+		l := open()
+		u := New(repo, inmemory.New(8, model.Key.Hash), l, 2)
+		if err := u.Restore(); err != nil {
+			t.Fatal(err)
+		}
+		return u, l
+	}
+
+	// Клики пишутся параллельно со сбросами, затем процесс "падает" без финального сброса.
+	// Каждый клик должен попасть в БД ровно один раз: либо сбросом до падения,
+	// либо из журнала после перезапуска, но не обоими путями.
+	const (
+		writers = 4
+		clicks  = 2000
+	)
+
+	before := &repository{data: make(map[model.Key]int64)}
+	u, l := restore(before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			u.FlushToDB(ctx)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range clicks {
+				u.Increment(w*10 + i%10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cancel()
+	<-done
+	l.Close()
+
+	after := &repository{data: make(map[model.Key]int64)}
+	u, l = restore(after)
+	u.FlushToDB(context.Background())
+
+	if got := before.total() + after.total(); got != writers*clicks {
+		t.Fatalf("flushed %d clicks, want %d", got, writers*clicks)
+	}
+
+	// Сброс удалил воспроизведенные сегменты: повторный перезапуск ничего не восстанавливает.
+	l.Close()
+
+	again := &repository{data: make(map[model.Key]int64)}
+	u, l = restore(again)
+	u.FlushToDB(context.Background())
+
+	if got := again.total(); got != 0 {
+		t.Fatalf("replayed %d clicks after release", got)
+	}
+
+	// Пока БД не подтвердила запись, сегмент не удаляется и переживает перезапуск.
+	again.err = context.DeadlineExceeded
+	u.Increment(1)
+	u.FlushToDB(context.Background())
+	l.Close()
+
+	last := &repository{data: make(map[model.Key]int64)}
+	u, l = restore(last)
+	defer l.Close()
+	u.FlushToDB(context.Background())
+
+	if got := last.total(); got != 1 {
+		t.Fatalf("replayed %d clicks after failed flush, want 1", got)
+	}
+}
+
+// Перенаправляет стандартный лог в буфер до конца теста.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestUsecase_Shutdown_DeadLetter(t *testing.T) {
+	logs := captureLog(t)
+
+	// Без журнала батч, не записанный финальным сбросом, не должен теряться молча:
+	// после последней попытки он выгружается в лог.
+	repo := &repository{data: make(map[model.Key]int64), err: context.DeadlineExceeded}
+	u := New(repo, inmemory.New(8, model.Key.Hash), nil, 2)
+
+	u.IncrementBy(42, 3)
+	u.Shutdown(context.Background())
+
+	if !strings.Contains(logs.String(), "Dead letter: banner_id=42 metric=click") || !strings.Contains(logs.String(), "v=3") {
+		t.Fatalf("failed batch is not dead-lettered, log:\n%s", logs)
+	}
+	if n := u.retry.len(); n != 0 {
+		t.Fatalf("%d batches left in retry queue after shutdown", n)
+	}
+}
+
+// Ручные часы очереди повторов.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestRetryQueue_Backoff(t *testing.T) {
+	c := &clock{t: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	q := retryQueue{now: c.now}
+
+	// Задержка удваивается с каждой попыткой от retryBaseDelay и не превышает retryMaxDelay.
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{retryMaxAttempts, time.Minute},
+		{70, time.Minute}, // Сдвиг переполняет Duration.
+	}
+
+	for _, tt := range tests {
+		p := &pending{attempts: tt.attempts}
+		q.push(p)
+
+		if got := p.next.Sub(c.t); got != tt.delay {
+			t.Errorf("attempts %d: delay %s, want %s", tt.attempts, got, tt.delay)
+		}
+	}
+
+	// Батч не извлекается раньше своей задержки, а при force - извлекается сразу.
+	q.items = nil
+	q.push(&pending{attempts: 1})
+	q.push(&pending{attempts: 3})
+
+	if due := q.pop(false); len(due) != 0 {
+		t.Fatalf("popped %d batches before delay", len(due))
+	}
+	c.advance(time.Second)
+	if due := q.pop(false); len(due) != 1 || due[0].attempts != 1 {
+		t.Fatalf("popped %v after 1s, want first batch", due)
+	}
+	if due := q.pop(true); len(due) != 1 || due[0].attempts != 3 || q.len() != 0 {
+		t.Fatalf("forced pop %v, %d left, want second batch", due, q.len())
+	}
+}
+
+func TestUsecase_RetryFailed(t *testing.T) {
+	data := func() map[model.Key]int64 {
+		return map[model.Key]int64{model.NewKey(7, model.Click, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)): 5}
+	}
+
+	// Неудачный батч повторяется по расписанию задержек, пока не исчерпает бюджет попыток,
+	// после чего выгружается в лог и покидает очередь.
+	t.Run("dead letter", func(t *testing.T) {
+		logs := captureLog(t)
+		c := &clock{t: time.Now()}
+
+		repo := &repository{data: make(map[model.Key]int64), err: context.DeadlineExceeded}
+		u := New(repo, inmemory.New(4, model.Key.Hash), nil, 1)
+		u.retry.now = c.now
+
+		u.retry.push(&pending{data: data(), attempts: 1})
+
+		for attempt := 2; attempt <= retryMaxAttempts; attempt++ {
+			u.retryFailed(context.Background(), false)
+			if repo.writes != attempt-2 {
+				t.Fatalf("attempt %d: %d writes before delay", attempt, repo.writes)
+			}
+
+			c.advance(min(retryBaseDelay<<(attempt-2), retryMaxDelay))
+			u.retryFailed(context.Background(), false)
+			if repo.writes != attempt-1 {
+				t.Fatalf("attempt %d: %d writes after delay", attempt, repo.writes)
+			}
+		}
+
+		if n := u.retry.len(); n != 0 {
+			t.Fatalf("%d batches left after %d attempts", n, retryMaxAttempts)
+		}
+		if !strings.Contains(logs.String(), fmt.Sprintf("Batch dropped after %d attempts", retryMaxAttempts)) ||
+			!strings.Contains(logs.String(), "Dead letter: banner_id=7 metric=click ts=2024-05-01T10:00:00Z v=5") {
+			t.Fatalf("batch is not dead-lettered, log:\n%s", logs)
+		}
+	})
+
+	// Успешный повтор записывает батч и убирает его из очереди.
+	t.Run("recovered", func(t *testing.T) {
+		c := &clock{t: time.Now()}
+
+		repo := &repository{data: make(map[model.Key]int64), err: context.DeadlineExceeded}
+		u := New(repo, inmemory.New(4, model.Key.Hash), nil, 1)
+		u.retry.now = c.now
+
+		u.retry.push(&pending{data: data(), attempts: 1})
+		c.advance(retryBaseDelay)
+		u.retryFailed(context.Background(), false)
+
+		repo.err = nil
+		c.advance(2 * retryBaseDelay)
+		u.retryFailed(context.Background(), false)
+
+		if n := u.retry.len(); n != 0 || repo.total() != 5 {
+			t.Fatalf("%d batches left, %d clicks written, want 0, 5", n, repo.total())
+		}
+	})
+
+	// Принудительный повтор при остановке не ждет задержки. Без журнала неудачный батч выгружается в лог,
+	// с журналом - остается в очереди: он будет восстановлен из журнала при следующем запуске.
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force wal=%v", journal), func(t *testing.T) {
+			logs := captureLog(t)
+
+			var l *wal.Log
+			if journal {
+				var err error
+				if l, err = wal.New(t.TempDir(), wal.SyncBatch, 0); err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+			}
+
+			repo := &repository{data: make(map[model.Key]int64), err: context.DeadlineExceeded}
+			u := New(repo, inmemory.New(4, model.Key.Hash), l, 1)
+			u.retry.now = (&clock{t: time.Now()}).now
+
+			u.retry.push(&pending{data: data(), attempts: 1})
+			u.retryFailed(context.Background(), true)
+
+			if repo.writes != 1 {
+				t.Fatalf("%d writes, want forced retry", repo.writes)
+			}
+			if dropped := strings.Contains(logs.String(), "Dead letter"); dropped == journal {
+				t.Fatalf("dead-lettered %v with wal %v, log:\n%s", dropped, journal, logs)
+			}
+			if want := map[bool]int{false: 0, true: 1}[journal]; u.retry.len() != want {
+				t.Fatalf("%d batches left, want %d", u.retry.len(), want)
+			}
+		})
+	}
+}
+
+// Сегменты журнала удаляются, только когда очередь повторов пуста:
+// пока батч не записан, его клики есть только в журнале.
+func TestUsecase_Retry_WALRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := wal.New(dir, wal.SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	segments := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	c := &clock{t: time.Now()}
+
+	repo := &repository{data: make(map[model.Key]int64), err: context.DeadlineExceeded}
+	u := New(repo, inmemory.New(4, model.Key.Hash), l, 1)
+	u.retry.now = c.now
+
+	u.Increment(1)
+	u.FlushToDB(context.Background())
+
+	// Батч в очереди: запечатанный сегмент остается, следующие сбросы сегменты тоже не удаляют.
+	u.Increment(2)
+	u.FlushToDB(context.Background())
+
+	if n := segments(); n != 3 || u.retry.len() != 2 {
+		t.Fatalf("%d segments, %d queued batches, want 3, 2", n, u.retry.len())
+	}
+
+	// БД восстановилась, но задержка повтора не прошла: сегменты все еще нужны.
+	repo.err = nil
+	u.FlushToDB(context.Background())
+
+	if n := segments(); n != 4 || u.retry.len() != 2 {
+		t.Fatalf("%d segments, %d queued batches before delay, want 4, 2", n, u.retry.len())
+	}
+
+	// Повтор записал все батчи: удаляются все запечатанные сегменты, остается текущий.
+	c.advance(retryBaseDelay)
+	u.FlushToDB(context.Background())
+
+	if n := segments(); n != 1 || u.retry.len() != 0 || repo.total() != 2 {
+		t.Fatalf("%d segments, %d queued batches, %d clicks, want 1, 0, 2", n, u.retry.len(), repo.total())
+	}
+}
+
+// Отказ журнала пишется в лог один раз, а не на каждый клик.
+func TestUsecase_WAL_AppendError(t *testing.T) {
+	logs := captureLog(t)
+
+	l, err := wal.New(t.TempDir(), wal.SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	repo := &repository{data: make(map[model.Key]int64)}
+	u := New(repo, inmemory.New(4, model.Key.Hash), l, 1)
+
+	for i := range 100 {
+		u.Increment(i)
+	}
+	u.IncrementBatch([]model.Increment{{ID: 1, Delta: 1}})
+
+	if n := strings.Count(logs.String(), "Failed to append to wal"); n != 1 {
+		t.Fatalf("logged %d append errors, want 1, log:\n%s", n, logs)
+	}
+}
+
+func TestFill_DST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 27 октября 2024 в Берлине длится 25 часов: переход на зимнее время.
+	q := model.Query{
+		From:        time.Date(2024, 10, 26, 12, 0, 0, 0, loc),
+		To:          time.Date(2024, 10, 28, 12, 0, 0, 0, loc),
+		Granularity: model.Day,
+		Location:    loc,
+		Fill:        model.FillNull,
+	}
+	stats := []model.Counter{{TS: time.Date(2024, 10, 27, 0, 0, 0, 0, loc), V: 5}}
+
+	series, err := fill(stats, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 {
+		t.Fatalf("got %d buckets, want 3", len(series))
+	}
+	if !series[0].Null || series[1].V != 5 || !series[2].Null {
+		t.Fatalf("unexpected series: %+v", series)
+	}
+	if got := series[2].TS.Sub(series[1].TS); got != 25*time.Hour {
+		t.Fatalf("DST day lasts %s, want 25h", got)
+	}
+}
+
+func TestFiller_Stream(t *testing.T) {
+	from := time.Date(2024, 5, 1, 10, 0, 30, 0, time.UTC)
+	q := model.Query{
+		BannerID:    1,
+		From:        from,
+		To:          from.Add(5 * time.Minute),
+		Granularity: model.Minute,
+		Location:    time.UTC,
+		Fill:        model.FillZero,
+	}
+	minute := func(i int) time.Time {
+		return from.Truncate(time.Minute).Add(time.Duration(i) * time.Minute)
+	}
+
+	stream := func(q model.Query, stats ...model.Counter) ([]model.Counter, error) {
+		var series []model.Counter
+
+		f := newFiller(q, func(c model.Counter) error {
+			series = append(series, c)
+			return nil
+		})
+		for _, c := range stats {
+			if err := f.push(c); err != nil {
+				return series, err
+			}
+		}
+		return series, f.close()
+	}
+
+	t.Run("zero", func(t *testing.T) {
+		// Пропуски в начале, в середине и в конце периода.
+		series, err := stream(q, model.Counter{ID: 1, TS: minute(1), V: 2}, model.Counter{ID: 1, TS: minute(3), V: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []int{0, 2, 0, 4, 0, 0}
+		if len(series) != len(want) {
+			t.Fatalf("got %d buckets, want %d: %+v", len(series), len(want), series)
+		}
+		for i, c := range series {
+			if !c.TS.Equal(minute(i)) || c.V != want[i] || c.Null || c.ID != 1 {
+				t.Fatalf("bucket %d: %+v, want ts %s v %d", i, c, minute(i), want[i])
+			}
+		}
+	})
+
+	t.Run("null", func(t *testing.T) {
+		q := q
+		q.Fill = model.FillNull
+
+		series, err := stream(q, model.Counter{ID: 1, TS: minute(5), V: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != 6 || series[5].Null || series[5].V != 1 {
+			t.Fatalf("unexpected series: %+v", series)
+		}
+		for _, c := range series[:5] {
+			if !c.Null {
+				t.Fatalf("gap %s is not null", c.TS)
+			}
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		q := q
+		q.Fill = model.FillNone
+
+		series, err := stream(q, model.Counter{ID: 1, TS: minute(3), V: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != 1 || !series[0].TS.Equal(minute(3)) {
+			t.Fatalf("unexpected series: %+v", series)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		q := q
+		q.To = q.From.Add(model.MaxBuckets * time.Minute)
+
+		series, err := stream(q)
+		if !errors.Is(err, model.ErrInvalidQuery) {
+			t.Fatalf("error %v, want ErrInvalidQuery", err)
+		}
+		if len(series) != model.MaxBuckets {
+			t.Fatalf("emitted %d buckets before error, want %d", len(series), model.MaxBuckets)
+		}
+	})
+}
+
+func TestUsecase_GetTop_Unflushed(t *testing.T) {
+	repo := &repository{data: make(map[model.Key]int64)}
+	u := New(repo, inmemory.New(8, model.Key.Hash), nil, 1)
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	// В БД: 1 - 5 кликов, 2 - 4 клика, 3 - 3 клика, плюс клики баннера 4 вне периода.
+	u.IncrementMetric(1, model.Click, 5)
+	u.IncrementMetric(2, model.Click, 4)
+	u.IncrementMetric(3, model.Click, 3)
+	u.cache.Add(model.NewKey(4, model.Click, old), 100)
+	u.FlushToDB(context.Background())
+
+	// В кэше: 3 обгоняет остальных, 2 догоняет 1, показы и старые клики не учитываются.
+	u.IncrementMetric(3, model.Click, 10)
+	u.IncrementMetric(2, model.Click, 1)
+	u.IncrementMetric(1, model.Impression, 100)
+	u.cache.Add(model.NewKey(4, model.Click, old), 100)
+
+	q := model.TopQuery{From: now.Add(-time.Hour), To: now.Add(time.Minute), Limit: 2}
+
+	top, err := u.GetTop(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.Top{{ID: 1, Total: 5, Rank: 1}, {ID: 2, Total: 4, Rank: 2}}
+	if !slices.Equal(top, want) {
+		t.Fatalf("flushed top = %v, want %v", top, want)
+	}
+
+	q.Unflushed = true
+	q.Limit = 3
+
+	top, err = u.GetTop(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []model.Top{{ID: 3, Total: 13, Rank: 1}, {ID: 1, Total: 5, Rank: 2}, {ID: 2, Total: 5, Rank: 2}}
+	if !slices.Equal(top, want) {
+		t.Fatalf("unflushed top = %v, want %v", top, want)
+	}
+}
+
+func TestCompare_Previous(t *testing.T) {
+	// Неделя по дням: предыдущий период - предыдущая неделя.
+	q := model.Query{
+		From:        time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+		To:          time.Date(2024, 1, 14, 23, 59, 59, 0, time.UTC),
+		Granularity: model.Day,
+		Location:    time.UTC,
+		Fill:        model.FillZero,
+	}
+
+	cq := compareQuery(q, model.Compare{Period: model.ComparePrevious})
+	if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !cq.From.Equal(want) {
+		t.Fatalf("compare from = %s, want %s", cq.From, want)
+	}
+	if want := time.Date(2024, 1, 7, 23, 59, 59, 0, time.UTC); !cq.To.Equal(want) {
+		t.Fatalf("compare to = %s, want %s", cq.To, want)
+	}
+
+	current := []model.Counter{{TS: q.From, V: 15}, {TS: q.From.AddDate(0, 0, 1), V: 4}}
+	previous := []model.Counter{{TS: cq.From, V: 10}, {TS: cq.From.AddDate(0, 0, 1)}}
+
+	c := compare(current, previous, cq)
+	if c.Deltas[0].Abs.V != 5 || *c.Deltas[0].Pct.V != 50 {
+		t.Fatalf("unexpected delta: %+v", c.Deltas[0])
+	}
+	if c.Deltas[1].Pct.V != nil {
+		t.Fatalf("pct against zero = %v, want nil", *c.Deltas[1].Pct.V)
+	}
+	if c.Totals.Current.V != 19 || c.Totals.Compare.V != 10 || c.Totals.Abs.V != 9 {
+		t.Fatalf("unexpected totals: %+v", c.Totals)
+	}
+}
+
+func TestUsecase_Live(t *testing.T) {
+	repo := &repository{data: make(map[model.Key]int64)}
+	u := New(repo, inmemory.New(8, model.Key.Hash), nil, 1)
+
+	// Опросом управляет тест: тик отправляется только после обработки предыдущего.
+	minute := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	ticks := make(chan time.Time)
+	u.live.tick = func() (<-chan time.Time, func()) { return ticks, func() {} }
+	u.live.now = func() time.Time { return minute.Add(30 * time.Second) }
+
+	receive := func(ch <-chan model.Counter) model.Counter {
+		t.Helper()
+		select {
+		case c := <-ch:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no live update")
+			return model.Counter{}
+		}
+	}
+
+	first, unsubscribe := u.Live(1)
+	defer unsubscribe()
+	second, _ := u.Live(1)
+
+	// Несброшенные клики текущей минуты плюс уже записанные в БД; прошлая минута не учитывается.
+	u.cache.Add(model.Key{ID: 1, Metric: model.Click, TS: minute.Unix()}, 3)
+	u.cache.Add(model.Key{ID: 1, Metric: model.Impression, TS: minute.Unix()}, 7)
+	u.cache.Add(model.Key{ID: 1, Metric: model.Click, TS: minute.Add(-time.Minute).Unix()}, 100)
+
+	ticks <- minute
+
+	// Оба подписчика получают значение из одного опроса.
+	for _, ch := range []<-chan model.Counter{first, second} {
+		if c := receive(ch); c.V != 3 || c.Impressions != 7 || !c.TS.Equal(minute) {
+			t.Fatalf("live counter = %+v, want v=3 impressions=7 at %s", c, minute)
+		}
+	}
+
+	// Неизменное значение повторно не рассылается. Следующий тик принимается
+	// только после обработки предыдущего, поэтому канал проверяется без ожидания.
+	ticks <- minute
+	ticks <- minute
+	select {
+	case c := <-first:
+		t.Fatalf("unexpected live update %+v", c)
+	default:
+	}
+
+	// Новый подписчик сразу получает последнее значение.
+	third, _ := u.Live(1)
+	if c := receive(third); c.V != 3 {
+		t.Fatalf("initial live counter = %+v, want v=3", c)
+	}
+
+	// Со сменой минуты счетчики начинаются заново.
+	minute = minute.Add(time.Minute)
+	u.cache.Add(model.Key{ID: 1, Metric: model.Click, TS: minute.Unix()}, 1)
+	ticks <- minute
+	for _, ch := range []<-chan model.Counter{first, second} {
+		if c := receive(ch); c.V != 1 || !c.TS.Equal(minute) {
+			t.Fatalf("live counter = %+v, want v=1 at %s", c, minute)
+		}
+	}
+
+	u.CloseLive()
+	if _, ok := <-second; ok {
+		t.Fatal("channel is open after CloseLive")
+	}
+}
+
+func TestUsecase_GetStats_Unflushed(t *testing.T) {
+	u := New(&repository{data: make(map[model.Key]int64)}, inmemory.New(8, model.Key.Hash), nil, 1)
+
+	u.IncrementBy(1, 2)
+	u.IncrementMetric(1, model.Conversion, 1)
+
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+
+	u.cache.Add(model.NewKey(1, model.Click, hour.Add(-time.Hour)), 5)
+	u.IncrementBy(2, 100)
+
+	q := model.Query{BannerID: 1, From: hour.Add(-time.Hour), To: now, Granularity: model.Hour, Unflushed: true}
+
+	stats, err := u.GetStats(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []model.Counter{
+		{ID: 1, TS: hour.Add(-time.Hour), V: 5},
+		{ID: 1, TS: hour, V: 2, Conversions: 1},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d buckets, want %d: %+v", len(stats), len(want), stats)
+	}
+	for i := range want {
+		if !stats[i].TS.Equal(want[i].TS) || stats[i].V != want[i].V || stats[i].Conversions != want[i].Conversions {
+			t.Fatalf("bucket %d = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
+
+func TestUsecase_GetStatsMulti_Empty(t *testing.T) {
+	u := New(&repository{data: make(map[model.Key]int64)}, inmemory.New(4, model.Key.Hash), nil, 1)
+
+	to := time.Now().UTC().Truncate(time.Hour)
+	q := model.Query{From: to.Add(-time.Hour), To: to, Granularity: model.Minute}
+
+	series, err := u.GetStatsMulti(context.Background(), []int{1, 2}, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Баннеры без данных возвращаются пустыми рядами, а не null.
+	data, err := json.Marshal(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"1":[],"2":[]}`; got != want {
+		t.Fatalf("series %s, want %s", got, want)
+	}
+
+	merged, err := u.GetStatsMerged(context.Background(), []int{1, 2}, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged == nil {
+		t.Fatal("merged series is nil")
+	}
+}
+
+func TestUsecase_GetSummary_Invalid(t *testing.T) {
+	repo := &repository{data: make(map[model.Key]int64)}
+	u := New(repo, inmemory.New(4, model.Key.Hash), nil, 1)
+
+	from := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	// Некорректный запрос отклоняется до обращения к БД.
+	for name, q := range map[string]model.Query{
+		"reversed":  {BannerID: 1, From: to, To: from, Granularity: model.Minute},
+		"fill":      {BannerID: 1, From: from, To: to, Granularity: model.Minute, Fill: model.FillZero},
+		"unflushed": {BannerID: 1, From: from, To: to, Granularity: model.Minute, Unflushed: true},
+	} {
+		if _, err := u.GetSummary(context.Background(), q); !errors.Is(err, model.ErrInvalidQuery) {
+			t.Errorf("%s: error %v, want ErrInvalidQuery", name, err)
+		}
+	}
+	if repo.summaries != 0 {
+		t.Fatal("invalid query reached repository")
+	}
+
+	if _, err := u.GetSummary(context.Background(), model.Query{BannerID: 1, From: from, To: to, Granularity: model.Minute}); err != nil || repo.summaries != 1 {
+		t.Fatalf("valid query: error %v, %d repository calls", err, repo.summaries)
+	}
+}
+
+func TestUsecase_UnflushedOf(t *testing.T) {
+	for name, cache := range map[string]model.Store{
+		"mutex":  inmemory.New(4, model.Key.Hash),
+		"atomic": inmemory.NewAtomic(4, model.Key.Hash),
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := New(&repository{data: make(map[model.Key]int64)}, cache, nil, 1)
+
+			now := time.Now()
+			for id := range 20 {
+				u.IncrementBy(id, int64(id+1))
+				u.IncrementMetric(id, model.Impression, 1)
+				cache.Add(model.NewKey(id, model.Click, now.Add(-time.Hour)), 1)
+			}
+
+			// Баннеры 1 и 5 лежат в одном шарде, 2 - в другом.
+			got := make(map[int]int64)
+			u.unflushedOf([]int{1, 2, 5, 100}, func(key model.Key, v int64) {
+				got[key.ID] += v
+			})
+
+			want := map[int]int64{1: 4, 2: 5, 5: 8}
+			if len(got) != len(want) {
+				t.Fatalf("unflushed %v, want %v", got, want)
+			}
+			for id, v := range want {
+				if got[id] != v {
+					t.Fatalf("unflushed %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
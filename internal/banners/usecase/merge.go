@@ -0,0 +1,48 @@
+package usecase
+
+import (
+	"slices"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Суммирует ряды нескольких баннеров в один ряд, отсортированный по времени.
+func merge(stats []model.Counter) []model.Counter {
+	var (
+		index  = make(map[int64]int, len(stats))
+		series = []model.Counter{} // Пустой ряд сериализуется как [], а не null.
+	)
+
+	for _, c := range stats {
+		key := c.TS.UnixNano()
+
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(series)
+			series = append(series, model.Counter{TS: c.TS})
+			i = len(series) - 1
+		}
+		series[i].V += c.V
+		series[i].Impressions += c.Impressions
+		series[i].Conversions += c.Conversions
+	}
+
+	slices.SortFunc(series, func(a, b model.Counter) int {
+		return a.TS.Compare(b.TS)
+	})
+	return series
+}
+
+// Убирает повторяющиеся ID, сохраняя порядок.
+func unique(ids []int) []int {
+	seen := make(map[int]struct{}, len(ids))
+	result := make([]int, 0, len(ids))
+
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			result = append(result, id)
+		}
+	}
+	return result
+}
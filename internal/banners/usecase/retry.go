@@ -0,0 +1,127 @@
+package usecase
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+const (
+	// Задержка перед первой повторной попыткой записи батча.
+	// Каждая следующая попытка откладывается вдвое дольше предыдущей.
+	retryBaseDelay = time.Second
+
+	// Максимальная задержка между повторными попытками.
+	retryMaxDelay = time.Minute
+
+	// Бюджет попыток записи батча, после которого он считается потерянным
+	// и выгружается в лог (dead letter) для последующей сверки.
+	retryMaxAttempts = 8
+)
+
+type (
+	// Батч, запись которого в БД завершилась ошибкой.
+	pending struct {
+		data     map[model.Key]int64
+		attempts int
+		next     time.Time // Время, раньше которого повтор не выполняется.
+	}
+
+	// Очередь батчей, ожидающих повторной записи в БД.
+	// Потокобезопасна: используется всеми воркерами сброса одновременно.
+	retryQueue struct {
+		mu    sync.Mutex
+		items []*pending
+		now   func() time.Time // Часы для расчета задержек, подменяются в тестах.
+	}
+)
+
+// Ставит батч в очередь с задержкой, зависящей от количества уже сделанных попыток.
+func (q *retryQueue) push(p *pending) {
+	delay := retryBaseDelay << (p.attempts - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	p.next = q.now().Add(delay)
+
+	q.mu.Lock()
+	q.items = append(q.items, p)
+	q.mu.Unlock()
+}
+
+// Количество батчей в очереди.
+func (q *retryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+// Извлекает из очереди батчи, готовые к повторной попытке.
+// При force извлекаются все батчи независимо от задержки.
+func (q *retryQueue) pop(force bool) []*pending {
+	now := q.now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*pending
+
+	rest := q.items[:0]
+	for _, p := range q.items {
+		if force || !p.next.After(now) {
+			due = append(due, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	clear(q.items[len(rest):])
+	q.items = rest
+
+	return due
+}
+
+// Обходит данные батчей, ожидающих в очереди.
+// Батчи в очереди не изменяются, поэтому их можно читать под блокировкой очереди.
+func (q *retryQueue) each(fn func(model.Key, int64)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range q.items {
+		for key, v := range p.data {
+			fn(key, v)
+		}
+	}
+}
+
+// Выполняет повторную запись готовых батчей.
+// Неудачные батчи возвращаются в очередь, исчерпавшие бюджет попыток выгружаются в лог.
+// При force (остановка сервиса) последняя неудача также считается исчерпанием бюджета,
+// если батч не сохранен в журнале: из журнала он будет восстановлен при следующем запуске.
+func (u *Usecase) retryFailed(ctx context.Context, force bool) {
+	for _, p := range u.retry.pop(force) {
+		err := u.repository.BatchData(ctx, p.data)
+		if err == nil {
+			continue
+		}
+
+		p.attempts++
+		if p.attempts >= retryMaxAttempts || (force && u.wal == nil) {
+			deadLetter(p, err)
+			continue
+		}
+		u.retry.push(p)
+	}
+}
+
+// Выгружает потерянный батч в лог, чтобы данные можно было восстановить вручную.
+func deadLetter(p *pending, err error) {
+	log.Printf("Batch dropped after %d attempts: %v", p.attempts, err)
+
+	for key, v := range p.data {
+		log.Printf("Dead letter: banner_id=%d metric=%s ts=%s v=%d", key.ID, key.Metric, key.Time().Format(time.RFC3339), v)
+	}
+}
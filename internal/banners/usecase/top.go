@@ -0,0 +1,90 @@
+package usecase
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Возвращает топ баннеров по кликам за период.
+// При q.Unflushed к данным БД добавляются клики из кэша и очереди повторов.
+// Батчи, которые пишутся в БД в момент запроса, не видны ни в кэше, ни в БД,
+// поэтому с q.Unflushed итог точнее, но не гарантированно точен.
+func (u *Usecase) GetTop(ctx context.Context, q model.TopQuery) ([]model.Top, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	top, err := u.repository.GetTop(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Unflushed {
+		if top, err = u.overlayTop(ctx, top, q); err != nil {
+			return nil, err
+		}
+	}
+
+	rank(top)
+	return top, nil
+}
+
+// Добавляет к топу из БД клики, еще не сброшенные в БД.
+// Баннер вне топа БД без несброшенных кликов не может обойти топ БД,
+// поэтому достаточно дозапросить итоги только баннеров с несброшенными кликами.
+func (u *Usecase) overlayTop(ctx context.Context, top []model.Top, q model.TopQuery) ([]model.Top, error) {
+	deltas := make(map[int]int64)
+	u.unflushed(func(key model.Key, v int64) {
+		if key.Metric != model.Click {
+			return
+		}
+		if ts := key.Time(); ts.Before(q.From) || ts.After(q.To) {
+			return
+		}
+		deltas[key.ID] += v
+	})
+	if len(deltas) == 0 {
+		return top, nil
+	}
+
+	for i := range top {
+		top[i].Total += deltas[top[i].ID]
+		delete(deltas, top[i].ID)
+	}
+
+	if len(deltas) > 0 {
+		ids := make([]int, 0, len(deltas))
+		for id := range deltas {
+			ids = append(ids, id)
+		}
+
+		totals, err := u.repository.GetTotals(ctx, ids, q.From, q.To)
+		if err != nil {
+			return nil, err
+		}
+
+		for id, v := range deltas {
+			top = append(top, model.Top{ID: id, Total: totals[id] + v})
+		}
+	}
+
+	slices.SortFunc(top, func(a, b model.Top) int {
+		return cmp.Or(cmp.Compare(b.Total, a.Total), cmp.Compare(a.ID, b.ID))
+	})
+	return top[:min(len(top), q.Limit)], nil
+}
+
+// Проставляет места в отсортированном по убыванию топе.
+// Баннеры с одинаковым итогом делят место, следующее место пропускается (1, 1, 3).
+func rank(top []model.Top) {
+	for i := range top {
+		if i > 0 && top[i].Total == top[i-1].Total {
+			top[i].Rank = top[i-1].Rank
+		} else {
+			top[i].Rank = i + 1
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package usecase
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+)
+
+// Обходит данные, еще не подтвержденные БД: кэш и очередь повторов.
+// Батчи, которые пишутся в БД в момент обхода, не видны ни в кэше, ни в БД.
+func (u *Usecase) unflushed(fn func(model.Key, int64)) {
+	u.cache.Range(fn)
+	u.retry.each(fn)
+}
+
+// Обходит данные баннеров ids, еще не подтвержденные БД.
+// Ключи баннера лежат в одном шарде кэша, поэтому обходятся только шарды запрошенных баннеров.
+func (u *Usecase) unflushedOf(ids []int, fn func(model.Key, int64)) {
+	set := make(map[int]struct{}, len(ids))
+	shards := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+		shards[u.cache.Shard(model.Key{ID: id})] = struct{}{}
+	}
+
+	filter := func(key model.Key, v int64) {
+		if _, ok := set[key.ID]; ok {
+			fn(key, v)
+		}
+	}
+
+	for i := range shards {
+		u.cache.RangeShard(i, filter)
+	}
+	u.retry.each(filter)
+}
+
+// Накладывает несброшенные данные баннеров ids за период q на статистику из БД.
+// Данные попадают в интервал минуты события. Статистика должна быть отсортирована
+// по баннеру, затем по времени, и остается отсортированной.
+func (u *Usecase) overlay(stats []model.Counter, ids []int, q model.Query) []model.Counter {
+	type bucket struct {
+		id int
+		ts int64
+	}
+
+	index := make(map[bucket]int, len(stats))
+	for i, c := range stats {
+		index[bucket{c.ID, c.TS.UnixNano()}] = i
+	}
+
+	added := false
+
+	u.unflushedOf(ids, func(key model.Key, v int64) {
+		if ts := key.Time(); ts.Before(q.From) || ts.After(q.To) {
+			return
+		}
+
+		ts := q.Granularity.Truncate(key.Time(), q.Location)
+
+		i, ok := index[bucket{key.ID, ts.UnixNano()}]
+		if !ok {
+			i = len(stats)
+			index[bucket{key.ID, ts.UnixNano()}] = i
+			stats = append(stats, model.Counter{ID: key.ID, TS: ts})
+			added = true
+		}
+		stats[i].Add(key.Metric, int(v))
+	})
+
+	if added {
+		slices.SortFunc(stats, func(a, b model.Counter) int {
+			return cmp.Or(cmp.Compare(a.ID, b.ID), a.TS.Compare(b.TS))
+		})
+	}
+	return stats
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+)
+
+type (
+	// Controller обрабатывает служебные HTTP запросы обслуживания БД.
+	Controller struct {
+		usecase model.Usecase
+	}
+)
+
+// Новый экземпляр Controller с переданным usecase.
+func New(usecase model.Usecase) *Controller {
+
+	return &Controller{
+		usecase,
+	}
+}
+
+// Возвращает текущие партиции banners_counter с границами, оценкой количества строк и размером.
+func (c *Controller) HandlePartitions(w http.ResponseWriter, r *http.Request) {
+	partitions, err := c.usecase.Partitions(r.Context())
+	if err != nil {
+		http.Error(w, "failed to get partitions", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(partitions)
+}
+
+// Возвращает отчет о том, что удалила бы политика хранения сейчас, ничего не удаляя.
+func (c *Controller) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	report, err := c.usecase.Retention(r.Context())
+	if err != nil {
+		http.Error(w, "failed to get retention report", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
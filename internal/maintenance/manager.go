@@ -0,0 +1,107 @@
+package maintenance
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/controller"
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+	"github.com/aaoreshkin/click-counter/internal/maintenance/repository"
+	"github.com/aaoreshkin/click-counter/internal/maintenance/usecase"
+	"github.com/aaoreshkin/click-counter/internal/provider/database"
+)
+
+type (
+	// Параметры модуля обслуживания БД.
+	Config struct {
+		MonthsAhead    int             // На сколько месяцев вперед создаются партиции.
+		Interval       time.Duration   // Интервал между запусками управления партициями и сроков хранения.
+		RollupInterval time.Duration   // Интервал между расчетами агрегатов.
+		Retention      model.Retention // Сроки хранения данных.
+	}
+
+	// Manager управляет жизненным циклом модуля обслуживания БД:
+	// периодически запускает управление партициями, расчет агрегатов и удаление устаревших данных
+	// и предоставляет HTTP контроллер для роутера.
+	Manager struct {
+		repository *repository.Repository
+		usecase    *usecase.Usecase
+		controller *controller.Controller
+
+		cancel context.CancelFunc // Останавливает периодическое обслуживание.
+		wg     sync.WaitGroup     // Ожидание завершения текущего обслуживания.
+	}
+)
+
+// Новый экземпляр Manager с полной инициализацией всех компонентов.
+// Запускает управление партициями и сроками хранения сразу и затем каждые config.Interval,
+// расчет агрегатов - сразу и затем каждые config.RollupInterval.
+// Обслуживание останавливается при отмене контекста или вызове Shutdown.
+func New(ctx context.Context, connection *database.Connection, config Config) *Manager {
+
+	repository := repository.New(connection)
+	usecase := usecase.New(repository, config.MonthsAhead, config.Retention)
+	controller := controller.New(usecase)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	m := &Manager{
+		repository: repository,
+		usecase:    usecase,
+		controller: controller,
+		cancel:     cancel,
+	}
+
+	m.run(ctx, config.Interval, "manage partitions", usecase.EnsurePartitions)
+	m.run(ctx, config.RollupInterval, "roll up counters", usecase.Rollup)
+	m.run(ctx, config.Interval, "enforce retention", usecase.EnforceRetention)
+
+	return m
+}
+
+// Считает агрегаты за историю начиная с from (с самых ранних данных при нулевом from).
+// Используется командой backfill и может выполняться параллельно с работающим сервисом.
+func Backfill(ctx context.Context, connection *database.Connection, from time.Time) error {
+
+	return usecase.New(repository.New(connection), 0, model.Retention{}).Backfill(ctx, from)
+}
+
+// Запускает задачу fn сразу и затем каждые interval до отмены контекста.
+func (m *Manager) run(ctx context.Context, interval time.Duration, name string, fn func(context.Context) error) {
+	m.wg.Add(1)
+
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(interval)
+
+		defer ticker.Stop()
+
+		for {
+			if err := fn(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to %s: %v", name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Останавливает периодическое обслуживание и дожидается завершения текущего запуска.
+// Прерванные операции откатываются транзакцией.
+func (m *Manager) Shutdown() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Возвращает HTTP контроллер для регистрации роутов.
+func (m *Manager) Controller() *controller.Controller {
+
+	return m.controller
+}
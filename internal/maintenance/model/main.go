@@ -0,0 +1,168 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Межпроцессные (advisory) блокировки задач обслуживания.
+// Задачи с разными блокировками выполняются параллельно, с одной - по очереди на всех репликах.
+const (
+	LockPartitions Lock = 1
+	LockRollup     Lock = 2
+)
+
+// Уровни агрегации. Дневные агрегаты считаются из часовых, часовые - из минутных данных.
+var (
+	Hourly = Rollup{Name: "hourly", Table: "banners_counter_hourly", Source: "banners_counter", Unit: time.Hour, Trunc: "hour", Next: &Daily}
+	Daily  = Rollup{Name: "daily", Table: "banners_counter_daily", Source: "banners_counter_hourly", Unit: 24 * time.Hour, Trunc: "day"}
+)
+
+type (
+	// Ключ межпроцессной блокировки задачи обслуживания.
+	Lock int32
+
+	// Уровень агрегации: таблица агрегатов и таблица, из которой они считаются.
+	// Интервалы агрегатов - часы или сутки UTC.
+	Rollup struct {
+		Name   string        // Имя уровня в banners_counter_rollup.
+		Table  string        // Таблица агрегатов.
+		Source string        // Таблица-источник.
+		Unit   time.Duration // Размер интервала.
+		Trunc  string        // Размер интервала для date_trunc.
+		Next   *Rollup       // Уровень, который считается из этого, nil - верхний уровень.
+	}
+
+	// Покрытие таблицы агрегатов: она содержит все данные за [From, To).
+	Coverage struct {
+		From time.Time
+		To   time.Time
+	}
+
+	// Партиция таблицы banners_counter.
+	// Bound - границы партиции в синтаксисе PostgreSQL ("FOR VALUES FROM (...) TO (...)" или "DEFAULT"),
+	// From и To - те же границы, у партиции по умолчанию их нет.
+	// Rows - оценка количества строк по статистике планировщика, Size - размер с индексами в байтах.
+	Partition struct {
+		Name  string     `json:"name"`
+		Bound string     `json:"bound"`
+		From  *time.Time `json:"from,omitempty"`
+		To    *time.Time `json:"to,omitempty"`
+		Rows  int64      `json:"rows"`
+		Size  int64      `json:"size"`
+	}
+
+	// Сроки хранения данных каждого уровня. Нулевой срок - хранить всегда.
+	// DryRun - только сообщать в лог, что было бы удалено.
+	Retention struct {
+		Minute time.Duration
+		Hourly time.Duration
+		Daily  time.Duration
+		DryRun bool
+	}
+
+	// Удаление строк таблицы агрегатов со временем до Before.
+	Expiry struct {
+		Table  string    `json:"table"`
+		Before time.Time `json:"before"`
+		Rows   int64     `json:"rows"`
+	}
+
+	// Что удаляется по политике хранения: минутные партиции целиком и старые строки агрегатов.
+	// Warnings - устаревшие данные, которые нельзя удалить, пока они не свернуты в агрегаты.
+	RetentionReport struct {
+		Partitions []Partition `json:"partitions"`
+		Hourly     *Expiry     `json:"hourly,omitempty"`
+		Daily      *Expiry     `json:"daily,omitempty"`
+		Warnings   []string    `json:"warnings,omitempty"`
+	}
+
+	// Определяет интерфейс бизнес-логики обслуживания БД.
+	// Абстрагирует controller от конкретной реализации usecase слоя.
+	Usecase interface {
+		Partitions(context.Context) ([]Partition, error)
+		Retention(context.Context) (RetentionReport, error)
+	}
+
+	// Определяет интерфейс репозитория обслуживания БД.
+	// Абстрагирует usecase от конкретной реализации хранилища данных.
+	Repository interface {
+		// Берет межпроцессную блокировку задачи, если она свободна.
+		// Блокировка снимается вызовом возвращенной функции.
+		TryLock(context.Context, Lock) (func(), bool, error)
+
+		Partitions(context.Context) ([]Partition, error)
+
+		// Месяцы, строки которых лежат в партиции по умолчанию или в неподключенной партиции.
+		DefaultMonths(context.Context) ([]time.Time, error)
+
+		// Создает партицию месяца, переносит в нее строки этого месяца из партиции по умолчанию
+		// и подключает ее к banners_counter. Прерванное создание продолжается повторным вызовом.
+		// При live в месяц еще идет запись: она может ожидать подключения, но не должна отклоняться.
+		CreatePartition(ctx context.Context, month time.Time, live bool) error
+
+		// Покрытие таблицы агрегатов. false, если агрегаты еще не считались.
+		Coverage(context.Context, Rollup) (Coverage, bool, error)
+
+		// Пересчитывает агрегаты за [from, to) из таблицы-источника и сохраняет новое покрытие.
+		// Снимает отметки пересчета уровня за [from, to) и отмечает интервалы следующего уровня.
+		// Выполняется в одной транзакции.
+		Rollup(ctx context.Context, rollup Rollup, from, to time.Time, coverage Coverage) error
+
+		// Отмеченные для пересчета интервалы уровня, начинающиеся в [from, to), по возрастанию.
+		Dirty(ctx context.Context, rollup Rollup, from, to time.Time) ([]time.Time, error)
+
+		// Количество интервалов уровня в [from, to), в которых итоги минутных данных
+		// расходятся с агрегатами уровня.
+		Mismatches(ctx context.Context, rollup Rollup, from, to time.Time) (int64, error)
+
+		// Время самой ранней строки banners_counter. false, если таблица пуста.
+		MinTS(context.Context) (time.Time, bool, error)
+
+		// Отключает партицию от banners_counter, удаляет ее и сдвигает начало хранимых минутных данных
+		// на конец партиции to. Выполняется в одной транзакции.
+		DropPartition(ctx context.Context, name string, to time.Time) error
+
+		// Количество строк таблицы агрегатов со временем до before.
+		CountBefore(ctx context.Context, rollup Rollup, before time.Time) (int64, error)
+
+		// Удаляет строки таблицы агрегатов и отметки пересчета уровня со временем до before
+		// и сдвигает начало покрытия. Выполняется в одной транзакции. Возвращает количество удаленных строк.
+		Expire(ctx context.Context, rollup Rollup, before time.Time) (int64, error)
+	}
+)
+
+// Имя месячной партиции banners_counter, например banners_counter_2025_07.
+func PartitionName(month time.Time) string {
+	return month.Format("banners_counter_2006_01")
+}
+
+// Начало ближайшего интервала уровня, не раньше t.
+func (r Rollup) Ceil(t time.Time) time.Time {
+	if f := t.Truncate(r.Unit); f.Before(t) {
+		return f.Add(r.Unit)
+	}
+	return t.Truncate(r.Unit)
+}
+
+// Проверяет политику хранения: более грубые данные должны храниться не меньше более мелких,
+// иначе удаление минутных данных теряло бы данные, уже удаленные из агрегатов.
+func (r Retention) Validate() error {
+	longer := func(coarse, fine time.Duration) bool {
+		return coarse == 0 || fine != 0 && coarse >= fine
+	}
+
+	if !longer(r.Hourly, r.Minute) {
+		return errors.New("hourly retention must not be shorter than minute retention")
+	}
+	if !longer(r.Daily, r.Hourly) || !longer(r.Daily, r.Minute) {
+		return errors.New("daily retention must not be shorter than hourly and minute retention")
+	}
+	return nil
+}
+
+// Включено ли удаление хотя бы одного уровня.
+func (r Retention) Enabled() bool {
+	return r.Minute != 0 || r.Hourly != 0 || r.Daily != 0
+}
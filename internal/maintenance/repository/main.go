@@ -0,0 +1,492 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+	"github.com/aaoreshkin/click-counter/internal/provider/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// Пространство ключей advisory-блокировок обслуживания БД (первый ключ pg_try_advisory_lock).
+	lockSpace int32 = 0x62635f6d // "bc_m"
+
+	// Количество строк, переносимых из партиции по умолчанию в новую партицию одной транзакцией.
+	partitionBatch = 10000
+)
+
+type (
+	// Repository предоставляет доступ к служебным операциям над таблицами счетчиков.
+	Repository struct {
+		connection *database.Connection
+	}
+
+	// Выполнение запроса в пуле соединений или в транзакции.
+	executor interface {
+		Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	}
+)
+
+// Новый экземпляр Repository с переданным подключением к БД.
+func New(connection *database.Connection) *Repository {
+
+	return &Repository{
+		connection,
+	}
+}
+
+// Берет сессионную advisory-блокировку задачи на отдельном соединении.
+// Если блокировку держит другая реплика, возвращает false без ожидания.
+func (r *Repository) TryLock(ctx context.Context, lock model.Lock) (func(), bool, error) {
+	conn, err := r.connection.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ok bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1, $2)`, lockSpace, int32(lock)).Scan(&ok); err != nil || !ok {
+		conn.Release()
+		return nil, false, err
+	}
+
+	unlock := func() {
+		// Контекст задачи может быть уже отменен, а блокировку нужно снять в любом случае.
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1, $2)`, lockSpace, int32(lock)); err != nil {
+			// Соединение с неснятой блокировкой не возвращается в пул: блокировка снимется при его закрытии.
+			conn.Hijack().Close(context.Background())
+			return
+		}
+		conn.Release()
+	}
+
+	return unlock, true, nil
+}
+
+// Возвращает партиции banners_counter, отсортированные по имени.
+// Границы разбираются из выражения партиции в самой БД, с теми же настройками сессии,
+// с которыми оно выведено.
+func (r *Repository) Partitions(ctx context.Context) ([]model.Partition, error) {
+	const query = `
+		SELECT
+			c.relname,
+			b.bound,
+			(regexp_match(b.bound, $1))[1]::timestamptz,
+			(regexp_match(b.bound, $1))[2]::timestamptz,
+			greatest(c.reltuples, 0)::bigint,
+			pg_total_relation_size(c.oid)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		CROSS JOIN LATERAL pg_get_expr(c.relpartbound, c.oid) AS b(bound)
+		WHERE i.inhparent = 'banners_counter'::regclass
+		ORDER BY c.relname
+	`
+
+	rows, err := r.connection.Query(ctx, query, `FROM \('([^']+)'\) TO \('([^']+)'\)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []model.Partition
+	for rows.Next() {
+		var p model.Partition
+		if err := rows.Scan(&p.Name, &p.Bound, &p.From, &p.To, &p.Rows, &p.Size); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+
+	return partitions, rows.Err()
+}
+
+// Возвращает месяцы, строки которых лежат в партиции по умолчанию,
+// а также месяцы неподключенных таблиц партиций, перенос в которые был прерван.
+// Границы месяцев считаются в часовом поясе сессии, как и границы партиций.
+// Партиция по умолчанию не сканируется целиком: месяцы перебираются от первого к следующему,
+// каждый шаг - поиск min(ts) после начала следующего месяца по индексу idx_banners_counter_ts.
+func (r *Repository) DefaultMonths(ctx context.Context) ([]time.Time, error) {
+	const query = `
+		WITH RECURSIVE months AS (
+			SELECT date_trunc('month', min(ts)) AS month
+			FROM banners_counter_default
+			UNION ALL
+			SELECT (
+				SELECT date_trunc('month', min(ts))
+				FROM banners_counter_default
+				WHERE ts >= m.month + interval '1 month'
+			)
+			FROM months m
+			WHERE m.month IS NOT NULL
+		)
+		SELECT to_char(month, 'YYYY-MM')
+		FROM months
+		WHERE month IS NOT NULL
+		UNION
+		SELECT substr(c.relname, 17, 4) || '-' || substr(c.relname, 22, 2)
+		FROM pg_class c
+		WHERE c.relname ~ '^banners_counter_\d{4}_\d{2}$' AND c.relkind = 'r' AND NOT c.relispartition
+			AND c.relnamespace = (SELECT relnamespace FROM pg_class WHERE oid = 'banners_counter'::regclass)
+	`
+
+	rows, err := r.connection.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var months []time.Time
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+
+		month, err := time.Parse("2006-01", s)
+		if err != nil {
+			return nil, err
+		}
+		months = append(months, month)
+	}
+
+	return months, rows.Err()
+}
+
+// Создает партицию месяца и подключает ее к banners_counter.
+// Подключить партицию, пока в партиции по умолчанию есть строки ее диапазона, нельзя,
+// а доказать их отсутствие можно только сканированием всей партиции по умолчанию, в которой может лежать
+// многомесячная история. Поэтому сначала создается отдельная таблица с ограничением диапазона месяца,
+// и строки месяца переносятся в нее пачками по partitionBatch, каждая в своей транзакции.
+// До подключения перенесенные строки не видны статистике. Дальше подключение зависит от live.
+//
+// Месяц, в который еще идет запись (live), подключается без ограничений на партиции по умолчанию:
+// в одной транзакции блокируется запись в banners_counter, переносятся строки, записанные во время
+// переноса, и партиция подключается со сканированием партиции по умолчанию. Запись на это время
+// ожидает, но не отклоняется, поэтому такой месяц создается последним, когда в партиции по умолчанию
+// остались только его новые строки.
+//
+// Для месяца без записи сканирование идет без блокировки записи:
+//   - на партицию по умолчанию ставится ограничение NOT VALID, исключающее месяц. С этого момента
+//     и до подключения запись строк месяца отклоняется, поэтому так создаются только месяцы,
+//     в которые запись не идет;
+//   - переносятся строки, записанные во время переноса;
+//   - ограничение проверяется VALIDATE CONSTRAINT, не блокирующим чтение и запись других месяцев;
+//   - в короткой транзакции партиция подключается без сканирования и ограничения удаляются.
+//
+// Каждый шаг безопасно повторить после сбоя. Границы задаются датами без часового пояса, как в исходной миграции.
+func (r *Repository) CreatePartition(ctx context.Context, month time.Time, live bool) error {
+	var (
+		name     = model.PartitionName(month)
+		table    = pgx.Identifier{name}.Sanitize()
+		bound    = pgx.Identifier{name + "_bound"}.Sanitize()
+		excluded = pgx.Identifier{name + "_excluded"}.Sanitize()
+		from     = month.Format(time.DateOnly)
+		to       = month.AddDate(0, 1, 0).Format(time.DateOnly)
+	)
+
+	create := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			LIKE banners_counter INCLUDING DEFAULTS INCLUDING CONSTRAINTS,
+			CONSTRAINT %s CHECK (ts >= '%s' AND ts < '%s')
+		)
+	`, table, bound, from, to)
+
+	exclude := fmt.Sprintf(`
+		ALTER TABLE banners_counter_default
+			DROP CONSTRAINT IF EXISTS %[1]s,
+			ADD CONSTRAINT %[1]s CHECK (ts < '%[2]s' OR ts >= '%[3]s') NOT VALID
+	`, excluded, from, to)
+
+	move := fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM banners_counter_default
+			WHERE ctid IN (
+				SELECT ctid FROM banners_counter_default
+				WHERE ts >= $1::timestamptz AND ts < $2::timestamptz
+				LIMIT $3
+			)
+			RETURNING banner_id, ts, v, impressions, conversions
+		)
+		INSERT INTO %s (banner_id, ts, v, impressions, conversions)
+		SELECT banner_id, ts, v, impressions, conversions FROM moved
+	`, table)
+
+	attach := fmt.Sprintf(`ALTER TABLE banners_counter ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`, table, from, to)
+
+	drain := func(db executor) error {
+		for {
+			tag, err := db.Exec(ctx, move, from, to, partitionBatch)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() < partitionBatch {
+				return nil
+			}
+		}
+	}
+
+	if _, err := r.connection.Exec(ctx, create); err != nil {
+		return err
+	}
+
+	if live {
+		// Ограничение могло остаться от прерванного создания, начатого до того, как в месяц пошла запись.
+		if _, err := r.connection.Exec(ctx, fmt.Sprintf(`ALTER TABLE banners_counter_default DROP CONSTRAINT IF EXISTS %s`, excluded)); err != nil {
+			return err
+		}
+	}
+
+	if err := drain(r.connection); err != nil {
+		return err
+	}
+
+	if !live {
+		if _, err := r.connection.Exec(ctx, exclude); err != nil {
+			return err
+		}
+		if err := drain(r.connection); err != nil {
+			return err
+		}
+		if _, err := r.connection.Exec(ctx, fmt.Sprintf(`ALTER TABLE banners_counter_default VALIDATE CONSTRAINT %s`, excluded)); err != nil {
+			return err
+		}
+	}
+
+	tx, err := r.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if live {
+		// Запись ждет блокировку на banners_counter до того, как выбрать партицию для строки,
+		// поэтому после подключения строки месяца сразу идут в новую партицию, а не отклоняются
+		// партицией по умолчанию. Чтение не блокируется.
+		if _, err := tx.Exec(ctx, `LOCK TABLE ONLY banners_counter IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+		if err := drain(tx); err != nil {
+			return err
+		}
+	}
+
+	// Индексы партиционированной таблицы создаются на партиции при подключении.
+	// Ограничение диапазона избавляет от сканирования таблицы, проверенное ограничение -
+	// от сканирования партиции по умолчанию.
+	queries := []string{attach, fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT %s`, table, bound)}
+	if !live {
+		queries = append(queries, fmt.Sprintf(`ALTER TABLE banners_counter_default DROP CONSTRAINT %s`, excluded))
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Возвращает покрытие таблицы агрегатов.
+func (r *Repository) Coverage(ctx context.Context, rollup model.Rollup) (model.Coverage, bool, error) {
+	const query = `SELECT rolled_from, rolled_to FROM banners_counter_rollup WHERE name = $1`
+
+	var c model.Coverage
+
+	err := r.connection.QueryRow(ctx, query, rollup.Name).Scan(&c.From, &c.To)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return model.Coverage{}, false, nil
+	}
+	if err != nil {
+		return model.Coverage{}, false, err
+	}
+	return c, true, nil
+}
+
+// Пересчитывает агрегаты за [from, to) и сохраняет покрытие в одной транзакции,
+// чтобы чтение статистики не увидело покрытие без агрегатов.
+// Агрегаты заменяются, а не прибавляются: повторный пересчет учитывает опоздавшие данные.
+// Отметки пересчета уровня за [from, to) снимаются до чтения источника: сброс, закоммиченный позже,
+// либо попадает в пересчет, либо заново отмечает свой час и будет учтен следующим запуском.
+// Интервалы следующего уровня, в которые попадает [from, to), отмечаются для пересчета.
+func (r *Repository) Rollup(ctx context.Context, rollup model.Rollup, from, to time.Time, coverage model.Coverage) error {
+	const clean = `DELETE FROM banners_counter_dirty WHERE name = $1 AND ts >= $2 AND ts < $3`
+
+	upsert := fmt.Sprintf(`
+		INSERT INTO %s (banner_id, ts, v, impressions, conversions)
+		SELECT banner_id, date_trunc('%s', ts, 'UTC'), sum(v), sum(impressions), sum(conversions)
+		FROM %s
+		WHERE ts >= $1 AND ts < $2
+		GROUP BY 1, 2
+		ON CONFLICT (banner_id, ts) DO UPDATE SET
+			v = EXCLUDED.v,
+			impressions = EXCLUDED.impressions,
+			conversions = EXCLUDED.conversions
+	`, pgx.Identifier{rollup.Table}.Sanitize(), rollup.Trunc, pgx.Identifier{rollup.Source}.Sanitize())
+
+	const mark = `
+		INSERT INTO banners_counter_dirty (name, ts)
+		SELECT $1, unnest($2::timestamptz[])
+		ON CONFLICT DO NOTHING
+	`
+
+	const state = `
+		INSERT INTO banners_counter_rollup (name, rolled_from, rolled_to)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET
+			rolled_from = EXCLUDED.rolled_from,
+			rolled_to = EXCLUDED.rolled_to
+	`
+
+	tx, err := r.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, clean, rollup.Name, from, to); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, upsert, from, to); err != nil {
+		return err
+	}
+	if next := rollup.Next; next != nil {
+		var buckets []time.Time
+		for ts := from.Truncate(next.Unit); ts.Before(to); ts = ts.Add(next.Unit) {
+			buckets = append(buckets, ts)
+		}
+		if _, err := tx.Exec(ctx, mark, next.Name, buckets); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, state, rollup.Name, coverage.From, coverage.To); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Возвращает отмеченные для пересчета интервалы уровня, начинающиеся в [from, to).
+func (r *Repository) Dirty(ctx context.Context, rollup model.Rollup, from, to time.Time) ([]time.Time, error) {
+	const query = `SELECT ts FROM banners_counter_dirty WHERE name = $1 AND ts >= $2 AND ts < $3 ORDER BY ts`
+
+	rows, err := r.connection.Query(ctx, query, rollup.Name, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[time.Time])
+}
+
+// Возвращает время самой ранней строки banners_counter.
+func (r *Repository) MinTS(ctx context.Context) (time.Time, bool, error) {
+	var ts *time.Time
+
+	if err := r.connection.QueryRow(ctx, `SELECT min(ts) FROM banners_counter`).Scan(&ts); err != nil || ts == nil {
+		return time.Time{}, false, err
+	}
+	return *ts, true, nil
+}
+
+// Отключает партицию от banners_counter и удаляет ее таблицу.
+// Отключение берет короткую эксклюзивную блокировку banners_counter.
+// В той же транзакции начало хранимых минутных данных сдвигается на конец партиции to:
+// чтение статистики не должно выдавать удаленный период за период без кликов.
+func (r *Repository) DropPartition(ctx context.Context, name string, to time.Time) error {
+	const horizon = `
+		INSERT INTO banners_counter_retention (name, horizon)
+		VALUES ('banners_counter', $1)
+		ON CONFLICT (name) DO UPDATE SET horizon = greatest(banners_counter_retention.horizon, EXCLUDED.horizon)
+	`
+
+	table := pgx.Identifier{name}.Sanitize()
+
+	tx, err := r.connection.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE banners_counter DETACH PARTITION %s`, table)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`DROP TABLE %s`, table)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, horizon, to); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Сверяет итоги минутных данных с агрегатами уровня по интервалам уровня в [from, to)
+// и возвращает количество интервалов, в которых они расходятся (в том числе отсутствующих с одной из сторон).
+func (r *Repository) Mismatches(ctx context.Context, rollup model.Rollup, from, to time.Time) (int64, error) {
+	query := fmt.Sprintf(`
+		WITH
+			minutes AS (
+				SELECT date_trunc('%[1]s', ts, 'UTC') AS ts, sum(v) AS v, sum(impressions) AS impressions, sum(conversions) AS conversions
+				FROM banners_counter
+				WHERE ts >= $1 AND ts < $2
+				GROUP BY 1
+			),
+			rollup AS (
+				SELECT date_trunc('%[1]s', ts, 'UTC') AS ts, sum(v) AS v, sum(impressions) AS impressions, sum(conversions) AS conversions
+				FROM %[2]s
+				WHERE ts >= $1 AND ts < $2
+				GROUP BY 1
+			)
+		SELECT count(*)
+		FROM minutes FULL JOIN rollup USING (ts)
+		WHERE (minutes.v, minutes.impressions, minutes.conversions)
+			IS DISTINCT FROM (rollup.v, rollup.impressions, rollup.conversions)
+	`, rollup.Trunc, pgx.Identifier{rollup.Table}.Sanitize())
+
+	var n int64
+	err := r.connection.QueryRow(ctx, query, from, to).Scan(&n)
+	return n, err
+}
+
+// Возвращает количество строк таблицы агрегатов со временем до before.
+func (r *Repository) CountBefore(ctx context.Context, rollup model.Rollup, before time.Time) (int64, error) {
+	query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE ts < $1`, pgx.Identifier{rollup.Table}.Sanitize())
+
+	var n int64
+	err := r.connection.QueryRow(ctx, query, before).Scan(&n)
+	return n, err
+}
+
+// Удаляет строки таблицы агрегатов со временем до before и сдвигает начало покрытия на before
+// в одной транзакции, чтобы чтение статистики не направлялось в удаленный период.
+// Отметки пересчета удаленного периода тоже удаляются: пересчитывать его больше не из чего.
+func (r *Repository) Expire(ctx context.Context, rollup model.Rollup, before time.Time) (int64, error) {
+	const state = `
+		UPDATE banners_counter_rollup SET rolled_from = $2
+		WHERE name = $1 AND rolled_from < $2
+	`
+
+	tx, err := r.connection.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, state, rollup.Name, before); err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE ts < $1`, pgx.Identifier{rollup.Table}.Sanitize()), before)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM banners_counter_dirty WHERE name = $1 AND ts < $2`, rollup.Name, before); err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
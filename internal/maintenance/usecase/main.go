@@ -0,0 +1,119 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+)
+
+// Сколько после конца месяца в него еще может идти запись: клики попадают в БД из кэша
+// и очереди повторов с задержкой.
+const lateWrites = time.Hour
+
+type (
+	// Слой бизнес-логики обслуживания БД: управление партициями banners_counter,
+	// агрегатами по часам и дням и сроками хранения данных.
+	Usecase struct {
+		repository model.Repository
+		ahead      int             // Количество месяцев вперед, на которые создаются партиции.
+		retention  model.Retention // Сроки хранения данных.
+	}
+)
+
+// Новый экземпляр Usecase, создающий партиции на ahead месяцев вперед
+// и удаляющий данные по политике хранения retention.
+func New(repository model.Repository, ahead int, retention model.Retention) *Usecase {
+
+	return &Usecase{
+		repository,
+		ahead,
+		retention,
+	}
+}
+
+// Создает месячные партиции на текущий месяц и u.ahead месяцев вперед, а также на месяцы,
+// строки которых попали в партицию по умолчанию, перенося эти строки в новые партиции.
+// Сначала создаются будущие партиции, чтобы они были готовы к началу своего месяца, затем прочие -
+// от новых к старым. Месяцы, в которые идет запись, создаются последними: их подключение
+// сканирует партицию по умолчанию, пока запись ожидает, а к этому моменту строки других месяцев
+// из нее уже перенесены.
+// Безопасен при запуске с нескольких реплик: выполняется только под advisory-блокировкой,
+// реплика, не получившая блокировку, пропускает запуск.
+func (u *Usecase) EnsurePartitions(ctx context.Context) error {
+	unlock, ok, err := u.repository.TryLock(ctx, model.LockPartitions)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	partitions, err := u.repository.Partitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	stray, err := u.repository.DefaultMonths(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	// Запись идет в текущий месяц и в прошедший, пока в него могут прийти запоздавшие клики.
+	live := func(month time.Time) bool {
+		return !now.Before(month) && now.Before(month.AddDate(0, 1, 0).Add(lateWrites))
+	}
+
+	var months, last []time.Time
+	add := func(month time.Time) {
+		if slices.ContainsFunc(months, month.Equal) || slices.ContainsFunc(last, month.Equal) {
+			return
+		}
+		if live(month) {
+			last = append(last, month)
+		} else {
+			months = append(months, month)
+		}
+	}
+
+	for i := 0; i <= u.ahead; i++ {
+		add(current.AddDate(0, i, 0))
+	}
+
+	slices.SortFunc(stray, func(a, b time.Time) int { return b.Compare(a) })
+	for _, month := range stray {
+		add(month)
+	}
+	months = append(months, last...)
+
+	var errs []error
+
+	for _, month := range months {
+		name := model.PartitionName(month)
+
+		if slices.ContainsFunc(partitions, func(p model.Partition) bool { return p.Name == name }) {
+			continue
+		}
+
+		// Ошибка одной партиции не мешает создать остальные.
+		if err := u.repository.CreatePartition(ctx, month, live(month)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Partition %s created", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Возвращает текущие партиции banners_counter.
+func (u *Usecase) Partitions(ctx context.Context) ([]model.Partition, error) {
+	return u.repository.Partitions(ctx)
+}
@@ -0,0 +1,346 @@
+package usecase
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+)
+
+// Репозиторий в памяти, запоминающий созданные партиции.
+type repository struct {
+	locked     bool // Блокировку держит другая реплика.
+	partitions []model.Partition
+	stray      []time.Time
+	created    []string
+	live       []string // Партиции, созданные без отклонения записи.
+
+	coverage map[string]model.Coverage
+	rolled   []rolled
+	minTS    time.Time
+	dirty    map[string][]time.Time // Отмеченные для пересчета интервалы по уровням.
+
+	mismatches map[time.Time]int64 // Расхождения минутных данных с агрегатами по началу сверяемого периода.
+
+	dropped []string
+	horizon time.Time // Начало хранимых минутных данных.
+	expired map[string]time.Time
+}
+
+// Вызов Rollup.
+type rolled struct {
+	name     string
+	from, to time.Time
+}
+
+func (r *repository) TryLock(context.Context, model.Lock) (func(), bool, error) {
+	return func() {}, !r.locked, nil
+}
+
+func (r *repository) Partitions(context.Context) ([]model.Partition, error) {
+	return r.partitions, nil
+}
+
+func (r *repository) DefaultMonths(context.Context) ([]time.Time, error) {
+	return r.stray, nil
+}
+
+func (r *repository) CreatePartition(_ context.Context, month time.Time, live bool) error {
+	r.created = append(r.created, model.PartitionName(month))
+	if live {
+		r.live = append(r.live, model.PartitionName(month))
+	}
+	return nil
+}
+
+func (r *repository) Coverage(_ context.Context, rollup model.Rollup) (model.Coverage, bool, error) {
+	c, ok := r.coverage[rollup.Name]
+	return c, ok, nil
+}
+
+func (r *repository) Rollup(_ context.Context, rollup model.Rollup, from, to time.Time, coverage model.Coverage) error {
+	if r.coverage == nil {
+		r.coverage = make(map[string]model.Coverage)
+	}
+	r.coverage[rollup.Name] = coverage
+	r.rolled = append(r.rolled, rolled{rollup.Name, from, to})
+
+	if r.dirty != nil {
+		r.dirty[rollup.Name] = slices.DeleteFunc(r.dirty[rollup.Name], func(ts time.Time) bool {
+			return !ts.Before(from) && ts.Before(to)
+		})
+	}
+	if next := rollup.Next; next != nil {
+		for ts := from.Truncate(next.Unit); ts.Before(to); ts = ts.Add(next.Unit) {
+			r.mark(next.Name, ts)
+		}
+	}
+	return nil
+}
+
+func (r *repository) Dirty(_ context.Context, rollup model.Rollup, from, to time.Time) ([]time.Time, error) {
+	var dirty []time.Time
+	for _, ts := range r.dirty[rollup.Name] {
+		if !ts.Before(from) && ts.Before(to) {
+			dirty = append(dirty, ts)
+		}
+	}
+	slices.SortFunc(dirty, time.Time.Compare)
+	return dirty, nil
+}
+
+func (r *repository) Mismatches(_ context.Context, _ model.Rollup, from, _ time.Time) (int64, error) {
+	return r.mismatches[from], nil
+}
+
+// Отмечает интервал уровня для пересчета, как сброс счетчиков или пересчет предыдущего уровня.
+func (r *repository) mark(name string, ts time.Time) {
+	if r.dirty == nil {
+		r.dirty = make(map[string][]time.Time)
+	}
+	if !slices.ContainsFunc(r.dirty[name], ts.Equal) {
+		r.dirty[name] = append(r.dirty[name], ts)
+	}
+}
+
+func (r *repository) MinTS(context.Context) (time.Time, bool, error) {
+	return r.minTS, !r.minTS.IsZero(), nil
+}
+
+func (r *repository) DropPartition(_ context.Context, name string, to time.Time) error {
+	r.dropped = append(r.dropped, name)
+	if to.After(r.horizon) {
+		r.horizon = to
+	}
+	return nil
+}
+
+func (r *repository) CountBefore(context.Context, model.Rollup, time.Time) (int64, error) {
+	return 1, nil
+}
+
+func (r *repository) Expire(_ context.Context, rollup model.Rollup, before time.Time) (int64, error) {
+	if r.expired == nil {
+		r.expired = make(map[string]time.Time)
+	}
+	r.expired[rollup.Name] = before
+	return 1, nil
+}
+
+func TestUsecase_EnsurePartitions(t *testing.T) {
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	stray := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	old := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	repo := &repository{
+		partitions: []model.Partition{{Name: "banners_counter_default"}},
+		stray:      []time.Time{old, current, stray, current.AddDate(0, 1, 0)},
+	}
+
+	if err := New(repo, 2, model.Retention{}).EnsurePartitions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сначала будущие партиции, затем прочие от новых к старым и последней - текущая, в которую идет запись.
+	want := []string{
+		model.PartitionName(current.AddDate(0, 1, 0)),
+		model.PartitionName(current.AddDate(0, 2, 0)),
+		model.PartitionName(stray),
+		model.PartitionName(old),
+		model.PartitionName(current),
+	}
+	if !slices.Equal(repo.created, want) {
+		t.Fatalf("created %v, want %v", repo.created, want)
+	}
+	if want := []string{model.PartitionName(current)}; !slices.Equal(repo.live, want) {
+		t.Fatalf("created live %v, want %v", repo.live, want)
+	}
+
+	// Пока блокировку держит другая реплика, партиции не создаются.
+	locked := &repository{locked: true}
+	if err := New(locked, 2, model.Retention{}).EnsurePartitions(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(locked.created) != 0 {
+		t.Fatalf("created %v under foreign lock", locked.created)
+	}
+}
+
+func TestUsecase_Rollup(t *testing.T) {
+	closed := time.Now().Add(-rollupGrace).Truncate(time.Hour)
+	day := closed.Truncate(24 * time.Hour)
+
+	// Первый запуск считает только последние часы, история считается backfill.
+	repo := &repository{minTS: day.AddDate(0, 0, -3).Add(90 * time.Minute)}
+	u := New(repo, 0, model.Retention{})
+
+	if err := u.Rollup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repo.coverage[model.Hourly.Name], (model.Coverage{From: closed.Add(-hourlyLookback).Truncate(24 * time.Hour), To: closed}); got != want {
+		t.Fatalf("hourly coverage %v, want %v", got, want)
+	}
+
+	if err := u.Backfill(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Агрегаты считаются с суток самой ранней строки.
+	if got, want := repo.coverage[model.Hourly.Name], (model.Coverage{From: day.AddDate(0, 0, -3), To: closed}); got != want {
+		t.Fatalf("hourly coverage %v, want %v", got, want)
+	}
+	if got, want := repo.coverage[model.Daily.Name], (model.Coverage{From: day.AddDate(0, 0, -3), To: day}); got != want {
+		t.Fatalf("daily coverage %v, want %v", got, want)
+	}
+
+	// Повторный запуск пересчитывает последние интервалы с учетом опоздавших данных.
+	repo.rolled = nil
+	if err := u.Rollup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []rolled{
+		{model.Hourly.Name, closed.Add(-hourlyLookback), closed},
+		{model.Daily.Name, day.Add(-dailyLookback), day},
+	}
+	if !slices.Equal(repo.rolled, want) {
+		t.Fatalf("rolled %v, want %v", repo.rolled, want)
+	}
+}
+
+func TestUsecase_Rollup_Dirty(t *testing.T) {
+	closed := time.Now().Add(-rollupGrace).Truncate(time.Hour)
+	day := closed.Truncate(24 * time.Hour)
+
+	repo := &repository{minTS: day.AddDate(0, 0, -3)}
+	u := New(repo, 0, model.Retention{})
+
+	if err := u.Backfill(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сбросы после расчета агрегатов отметили часы двое суток назад и текущий, еще не посчитанный час.
+	late := day.AddDate(0, 0, -2).Add(10 * time.Hour)
+	for _, ts := range []time.Time{late, late.Add(time.Hour), late.Add(5 * time.Hour), closed} {
+		repo.mark(model.Hourly.Name, ts)
+	}
+
+	repo.rolled = nil
+	if err := u.Rollup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Подряд идущие часы пересчитываются вместе, пересчет часов отмечает их сутки для дневных агрегатов.
+	want := []rolled{
+		{model.Hourly.Name, closed.Add(-hourlyLookback), closed},
+		{model.Hourly.Name, late, late.Add(2 * time.Hour)},
+		{model.Hourly.Name, late.Add(5 * time.Hour), late.Add(6 * time.Hour)},
+		{model.Daily.Name, day.Add(-dailyLookback), day},
+		{model.Daily.Name, day.AddDate(0, 0, -2), day.AddDate(0, 0, -1)},
+	}
+	if !slices.Equal(repo.rolled, want) {
+		t.Fatalf("rolled %v, want %v", repo.rolled, want)
+	}
+
+	// Еще не посчитанный час остается отмеченным до расчета.
+	if dirty, _ := repo.Dirty(context.Background(), model.Hourly, time.Time{}, closed.Add(time.Hour)); !slices.EqualFunc(dirty, []time.Time{closed}, time.Time.Equal) {
+		t.Fatalf("hourly dirty %v, want %v", dirty, closed)
+	}
+
+	// Час, минутные данные которого могли быть удалены по сроку хранения, не пересчитывается:
+	// пересчет заменил бы агрегаты неполными данными.
+	stale := day.AddDate(0, 0, -3).Add(time.Hour)
+	repo.mark(model.Hourly.Name, stale)
+
+	repo.rolled = nil
+	if err := New(repo, 0, model.Retention{Minute: 48 * time.Hour}).Rollup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range repo.rolled {
+		if r.name == model.Hourly.Name && !r.from.After(stale) {
+			t.Fatalf("stale hour %s rolled up: %v", stale, repo.rolled)
+		}
+	}
+}
+
+func TestUsecase_EnforceRetention(t *testing.T) {
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	day := now.Truncate(24 * time.Hour)
+
+	partition := func(month time.Time) model.Partition {
+		to := month.AddDate(0, 1, 0)
+		return model.Partition{Name: model.PartitionName(month), From: &month, To: &to}
+	}
+
+	old := current.AddDate(0, -6, 0)
+	repo := &repository{
+		partitions: []model.Partition{
+			{Name: "banners_counter_default"},
+			partition(old.AddDate(0, -1, 0)), // Не свернута в агрегаты.
+			partition(old),
+			partition(old.AddDate(0, 1, 0)), // Свернута, но итоги расходятся с агрегатами.
+			partition(current),
+		},
+		coverage: map[string]model.Coverage{
+			model.Hourly.Name: {From: old, To: day},
+			model.Daily.Name:  {From: old, To: day},
+		},
+		mismatches: map[time.Time]int64{old.AddDate(0, 1, 0): 3},
+	}
+
+	// Сутки, ожидающие пересчета из часовых агрегатов, ограничивают удаление часовых строк.
+	hourlyCutoff := now.AddDate(0, 0, -60).Truncate(24 * time.Hour)
+	repo.mark(model.Daily.Name, hourlyCutoff.AddDate(0, 0, -5))
+
+	retention := model.Retention{Minute: 30 * 24 * time.Hour, Hourly: 60 * 24 * time.Hour}
+	if err := retention.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// В режиме dry-run ничего не удаляется.
+	retention.DryRun = true
+	if err := New(repo, 0, retention).EnforceRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.dropped) != 0 || len(repo.expired) != 0 {
+		t.Fatalf("dry run dropped %v, expired %v", repo.dropped, repo.expired)
+	}
+
+	retention.DryRun = false
+	if err := New(repo, 0, retention).EnforceRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{model.PartitionName(old)}; !slices.Equal(repo.dropped, want) {
+		t.Fatalf("dropped %v, want %v", repo.dropped, want)
+	}
+	if want := old.AddDate(0, 1, 0); !repo.horizon.Equal(want) {
+		t.Fatalf("minute horizon %s, want %s", repo.horizon, want)
+	}
+
+	want := map[string]time.Time{model.Hourly.Name: hourlyCutoff.AddDate(0, 0, -5)}
+	if len(repo.expired) != 1 || !repo.expired[model.Hourly.Name].Equal(want[model.Hourly.Name]) {
+		t.Fatalf("expired %v, want %v", repo.expired, want)
+	}
+
+	// Партиции, которые нельзя удалить, попадают в предупреждения отчета.
+	report, err := New(repo, 0, retention).Retention(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(report.Warnings, func(w string) bool {
+		return strings.Contains(w, model.PartitionName(old.AddDate(0, 1, 0)))
+	}) {
+		t.Fatalf("warnings %v do not mention mismatched partition", report.Warnings)
+	}
+
+	// Часовые данные не могут храниться меньше минутных.
+	if err := (model.Retention{Minute: 30 * 24 * time.Hour, Hourly: 7 * 24 * time.Hour}).Validate(); err == nil {
+		t.Fatal("expected validation error")
+	}
+}
@@ -0,0 +1,192 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+)
+
+// Удаляет данные старше сроков хранения: минутные партиции целиком, когда их данные свернуты
+// в агрегаты, и строки часовых и дневных агрегатов. В режиме DryRun только пишет в лог, что было бы удалено.
+// Выполняется под блокировкой расчета агрегатов: обе задачи меняют покрытие агрегатов.
+func (u *Usecase) EnforceRetention(ctx context.Context) error {
+	if !u.retention.Enabled() {
+		return nil
+	}
+
+	unlock, ok, err := u.repository.TryLock(ctx, model.LockRollup)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	report, err := u.plan(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range report.Warnings {
+		log.Printf("Retention: %s", warning)
+	}
+
+	if u.retention.DryRun {
+		for _, p := range report.Partitions {
+			log.Printf("Retention dry run: would drop partition %s", p.Name)
+		}
+		for _, e := range []*model.Expiry{report.Hourly, report.Daily} {
+			if e != nil {
+				log.Printf("Retention dry run: would delete %d rows of %s before %s", e.Rows, e.Table, e.Before.Format(time.RFC3339))
+			}
+		}
+		return nil
+	}
+
+	var errs []error
+
+	for _, p := range report.Partitions {
+		if err := u.repository.DropPartition(ctx, p.Name, *p.To); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Retention: partition %s dropped", p.Name)
+	}
+
+	for _, e := range []struct {
+		rollup model.Rollup
+		expiry *model.Expiry
+	}{{model.Hourly, report.Hourly}, {model.Daily, report.Daily}} {
+		if e.expiry == nil {
+			continue
+		}
+
+		n, err := u.repository.Expire(ctx, e.rollup, e.expiry.Before)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("Retention: deleted %d rows of %s before %s", n, e.rollup.Table, e.expiry.Before.Format(time.RFC3339))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Возвращает отчет о том, что удалила бы политика хранения сейчас.
+func (u *Usecase) Retention(ctx context.Context) (model.RetentionReport, error) {
+	return u.plan(ctx, time.Now())
+}
+
+// Рассчитывает, что удаляется по политике хранения на момент now.
+// Данные уровня удаляются, только если они есть в более грубом уровне:
+// минутная партиция - если ее период покрыт часовыми агрегатами (или дневными, когда часовые
+// за этот период тоже устарели) и итоги партиции сходятся с ними, часовые строки - если их период
+// покрыт дневными агрегатами и в нем нет суток, ожидающих пересчета.
+// Покрытию одному не доверяем: данные, записанные после расчета агрегатов и еще не пересчитанные,
+// были бы потеряны вместе с партицией.
+func (u *Usecase) plan(ctx context.Context, now time.Time) (model.RetentionReport, error) {
+	report := model.RetentionReport{Partitions: []model.Partition{}}
+
+	hourly, hok, err := u.repository.Coverage(ctx, model.Hourly)
+	if err != nil {
+		return report, err
+	}
+	daily, dok, err := u.repository.Coverage(ctx, model.Daily)
+	if err != nil {
+		return report, err
+	}
+
+	// Граница устаревания часовых данных: до нее достаточно дневных агрегатов.
+	var hourlyCutoff time.Time
+	if u.retention.Hourly != 0 {
+		hourlyCutoff = now.Add(-u.retention.Hourly).Truncate(model.Daily.Unit)
+	}
+
+	if u.retention.Minute != 0 {
+		partitions, err := u.repository.Partitions(ctx)
+		if err != nil {
+			return report, err
+		}
+
+		cutoff := now.Add(-u.retention.Minute)
+
+		for _, p := range partitions {
+			if p.From == nil || p.To == nil || p.To.After(cutoff) {
+				continue
+			}
+
+			var rollup model.Rollup
+
+			switch {
+			case hok && covers(hourly, *p.From, *p.To):
+				rollup = model.Hourly
+			case dok && !p.To.After(hourlyCutoff) && covers(daily, *p.From, *p.To):
+				rollup = model.Daily
+			default:
+				report.Warnings = append(report.Warnings, fmt.Sprintf("partition %s is expired but not rolled up, run backfill", p.Name))
+				continue
+			}
+
+			// Сверяются интервалы уровня, целиком лежащие в партиции: границы партиций задаются
+			// в часовом поясе БД и могут не совпадать с интервалами агрегатов UTC.
+			n, err := u.repository.Mismatches(ctx, rollup, rollup.Ceil(*p.From), p.To.Truncate(rollup.Unit))
+			if err != nil {
+				return report, err
+			}
+			if n != 0 {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("partition %s differs from %s rollups in %d intervals, wait for rollup or run backfill", p.Name, rollup.Name, n))
+				continue
+			}
+
+			report.Partitions = append(report.Partitions, p)
+		}
+	}
+
+	if hok && hourlyCutoff.After(hourly.From) {
+		before := hourlyCutoff
+		if dok && before.After(daily.To) {
+			before = daily.To
+		}
+
+		// Сутки, ожидающие пересчета, считаются из часовых агрегатов: их часы пока нельзя удалять.
+		dirty, err := u.repository.Dirty(ctx, model.Daily, hourly.From, before)
+		if err != nil {
+			return report, err
+		}
+		if len(dirty) != 0 {
+			before = dirty[0]
+		}
+
+		if dok && !daily.From.After(hourly.From) && before.After(hourly.From) {
+			n, err := u.repository.CountBefore(ctx, model.Hourly, before)
+			if err != nil {
+				return report, err
+			}
+			report.Hourly = &model.Expiry{Table: model.Hourly.Table, Before: before, Rows: n}
+		} else {
+			report.Warnings = append(report.Warnings, "expired hourly rollups are not rolled up into daily, run backfill")
+		}
+	}
+
+	if dok && u.retention.Daily != 0 {
+		if before := now.Add(-u.retention.Daily).Truncate(model.Daily.Unit); before.After(daily.From) {
+			n, err := u.repository.CountBefore(ctx, model.Daily, before)
+			if err != nil {
+				return report, err
+			}
+			report.Daily = &model.Expiry{Table: model.Daily.Table, Before: before, Rows: n}
+		}
+	}
+
+	return report, nil
+}
+
+// Покрывают ли агрегаты период [from, to).
+func covers(c model.Coverage, from, to time.Time) bool {
+	return !from.Before(c.From) && !to.After(c.To)
+}
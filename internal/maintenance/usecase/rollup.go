@@ -0,0 +1,229 @@
+package usecase
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aaoreshkin/click-counter/internal/maintenance/model"
+)
+
+const (
+	// Задержка, после которой интервал считается закрытым: за это время данные
+	// интервала успевают сброситься из кэша, в том числе после нескольких повторов.
+	rollupGrace = 5 * time.Minute
+
+	// Окна пересчета последних агрегатов при каждом запуске. Опоздавшие данные учитываются
+	// по отметкам пересчета (refresh), окна страхуют строки, записанные без отметки
+	// (например, репликой предыдущей версии во время обновления).
+	hourlyLookback = 3 * time.Hour
+	dailyLookback  = 24 * time.Hour
+
+	// Размер шага backfill: каждый шаг - отдельная транзакция.
+	hourlyBackfillChunk = 24 * time.Hour
+	dailyBackfillChunk  = 30 * 24 * time.Hour
+
+	// Интервал повторных попыток взять блокировку при backfill.
+	backfillLockRetry = time.Second
+)
+
+// Досчитывает часовые и дневные агрегаты за закрывшиеся интервалы и пересчитывает уже посчитанные
+// интервалы, данные которых записаны после расчета (повторы записи, восстановление из журнала).
+// Безопасен при запуске с нескольких реплик: выполняется только под advisory-блокировкой.
+func (u *Usecase) Rollup(ctx context.Context) error {
+	unlock, ok, err := u.repository.TryLock(ctx, model.LockRollup)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	now := time.Now()
+
+	// Минутные данные покрывают все время до последнего закрытого часа.
+	minutes := model.Coverage{To: now.Add(-rollupGrace)}
+
+	// Пересчет заменяет агрегаты, поэтому пересчитываются только интервалы, источник которых цел:
+	// часы, минутные партиции которых не могли быть удалены по сроку хранения,
+	// и сутки, часовые агрегаты которых не удалены (начало их покрытия выровнено по суткам).
+	var fresh time.Time
+	if u.retention.Minute != 0 {
+		fresh = now.Add(-u.retention.Minute)
+	}
+
+	hourly, err := u.advance(ctx, model.Hourly, minutes, hourlyLookback)
+	if err != nil {
+		return err
+	}
+	// Пересчет часов отмечает их сутки, поэтому выполняется до дневных агрегатов.
+	if err := u.refresh(ctx, model.Hourly, hourly, fresh, hourlyBackfillChunk); err != nil {
+		return err
+	}
+
+	daily, err := u.advance(ctx, model.Daily, hourly, dailyLookback)
+	if err != nil {
+		return err
+	}
+	return u.refresh(ctx, model.Daily, daily, hourly.From, dailyBackfillChunk)
+}
+
+// Досчитывает уровень rollup вперед до конца покрытия источника source,
+// заново пересчитывая последние lookback уже посчитанных агрегатов. Возвращает новое покрытие.
+func (u *Usecase) advance(ctx context.Context, rollup model.Rollup, source model.Coverage, lookback time.Duration) (model.Coverage, error) {
+	lo, hi := rollup.Ceil(source.From), source.To.Truncate(rollup.Unit)
+
+	// Без backfill агрегаты считаются с последних lookback закрытых интервалов.
+	c, err := u.coverage(ctx, rollup, lo, hi.Add(-lookback).Truncate(model.Daily.Unit))
+	if err != nil {
+		return model.Coverage{}, err
+	}
+
+	from := c.To.Add(-lookback)
+	if from.Before(c.From) {
+		from = c.From
+	}
+	if from.Before(lo) {
+		from = lo
+	}
+	if !hi.After(from) {
+		return c, nil
+	}
+
+	next := model.Coverage{From: c.From, To: c.To}
+	if hi.After(next.To) {
+		next.To = hi
+	}
+
+	if err := u.repository.Rollup(ctx, rollup, from, hi, next); err != nil {
+		return model.Coverage{}, err
+	}
+	return next, nil
+}
+
+// Пересчитывает отмеченные интервалы уровня rollup в пределах покрытия c, начиная не раньше from.
+// Подряд идущие интервалы пересчитываются вместе, но не больше chunk за транзакцию.
+// Интервалы после конца покрытия остаются отмеченными: их посчитает advance.
+// Отметки раньше from остаются до удаления агрегатов по сроку хранения (Expire).
+func (u *Usecase) refresh(ctx context.Context, rollup model.Rollup, c model.Coverage, from time.Time, chunk time.Duration) error {
+	if from.Before(c.From) {
+		from = c.From
+	}
+	if !c.To.After(from) {
+		return nil
+	}
+
+	dirty, err := u.repository.Dirty(ctx, rollup, from, c.To)
+	if err != nil || len(dirty) == 0 {
+		return err
+	}
+
+	for i := 0; i < len(dirty); {
+		from, to := dirty[i], dirty[i].Add(rollup.Unit)
+		for i++; i < len(dirty) && dirty[i].Equal(to) && to.Sub(from) < chunk; i++ {
+			to = to.Add(rollup.Unit)
+		}
+
+		if err := u.repository.Rollup(ctx, rollup, from, to, c); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rollup %s: refreshed %d late intervals", rollup.Name, len(dirty))
+	return nil
+}
+
+// Считает агрегаты за историю: часовые начиная с суток from (но не раньше самых ранних данных),
+// затем дневные за все время, покрытое часовыми. Идет назад от начала текущего покрытия шагами,
+// каждый шаг - отдельная транзакция, поэтому прерванный backfill продолжается с места остановки.
+// Ждет, пока блокировку агрегатов держит другой процесс.
+func (u *Usecase) Backfill(ctx context.Context, from time.Time) error {
+	unlock, err := u.lock(ctx, model.LockRollup)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Раньше самых ранних минутных данных считать нечего: за этот период они могли быть
+	// удалены по сроку хранения, и пустые агрегаты заменили бы собой уже посчитанные.
+	ts, ok, err := u.repository.MinTS(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	if from.Before(ts) {
+		from = ts
+	}
+
+	minutes := model.Coverage{From: from.Truncate(model.Daily.Unit), To: time.Now().Add(-rollupGrace)}
+
+	hourly, err := u.backfill(ctx, model.Hourly, minutes, hourlyBackfillChunk)
+	if err != nil {
+		return err
+	}
+
+	_, err = u.backfill(ctx, model.Daily, hourly, dailyBackfillChunk)
+	return err
+}
+
+// Досчитывает уровень rollup назад до начала покрытия источника source шагами по chunk.
+func (u *Usecase) backfill(ctx context.Context, rollup model.Rollup, source model.Coverage, chunk time.Duration) (model.Coverage, error) {
+	lo, hi := rollup.Ceil(source.From), source.To.Truncate(rollup.Unit)
+
+	c, err := u.coverage(ctx, rollup, lo, hi)
+	if err != nil {
+		return model.Coverage{}, err
+	}
+
+	for c.From.After(lo) {
+		start := c.From.Add(-chunk)
+		if start.Before(lo) {
+			start = lo
+		}
+
+		next := model.Coverage{From: start, To: c.To}
+		if err := u.repository.Rollup(ctx, rollup, start, c.From, next); err != nil {
+			return model.Coverage{}, err
+		}
+		c = next
+
+		log.Printf("Backfill %s: rolled up from %s", rollup.Name, start.Format(time.RFC3339))
+	}
+
+	return c, nil
+}
+
+// Возвращает покрытие уровня rollup. Если агрегаты еще не считались, покрытие пустое
+// и начинается со start, но не раньше начала покрытия источника lo.
+// Начало покрытия выравнивается по суткам, чтобы дневные агрегаты могли покрыть часовые целиком
+// и часовые агрегаты можно было удалять по сроку хранения без потери данных.
+func (u *Usecase) coverage(ctx context.Context, rollup model.Rollup, lo, start time.Time) (model.Coverage, error) {
+	c, ok, err := u.repository.Coverage(ctx, rollup)
+	if err != nil || ok {
+		return c, err
+	}
+
+	if start.Before(lo) {
+		start = lo
+	}
+	return model.Coverage{From: start, To: start}, nil
+}
+
+// Берет блокировку задачи, дожидаясь ее освобождения другим процессом.
+func (u *Usecase) lock(ctx context.Context, lock model.Lock) (func(), error) {
+	for {
+		unlock, ok, err := u.repository.TryLock(ctx, lock)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return unlock, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backfillLockRetry):
+		}
+	}
+}
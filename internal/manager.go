@@ -2,12 +2,21 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"os"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/aaoreshkin/click-counter/internal/banners"
+	"github.com/aaoreshkin/click-counter/internal/banners/model"
+	"github.com/aaoreshkin/click-counter/internal/banners/repository"
+	"github.com/aaoreshkin/click-counter/internal/maintenance"
+	maintenancemodel "github.com/aaoreshkin/click-counter/internal/maintenance/model"
 	"github.com/aaoreshkin/click-counter/internal/provider/database"
 	"github.com/aaoreshkin/click-counter/internal/provider/inmemory"
+	"github.com/aaoreshkin/click-counter/internal/provider/wal"
 )
 
 const (
@@ -15,12 +24,26 @@ const (
 	// Оптимальное значение зависит от нагрузки и производительности БД.
 	workers = 4
 
-	// Количество шардов кэша.
-	shards = 128
-
 	// Интервал между сбросами кэша в БД.
 	// Меньший интервал = меньше потерь при сбоях, но больше нагрузка на БД.
 	interval = time.Second
+
+	// Интервал fsync журнала в режиме WAL_SYNC=interval.
+	walSyncInterval = 100 * time.Millisecond
+
+	// Максимальное количество элементов в пакетном инкременте по умолчанию.
+	// Переопределяется переменной окружения COUNTER_BATCH_LIMIT.
+	batchLimit = 10000
+
+	// Количество месяцев вперед, на которые создаются партиции banners_counter, по умолчанию.
+	// Переопределяется переменной окружения PARTITION_MONTHS_AHEAD.
+	monthsAhead = 3
+
+	// Интервал между запусками обслуживания БД (управление партициями).
+	maintenanceInterval = time.Hour
+
+	// Интервал расчета часовых и дневных агрегатов.
+	rollupInterval = 5 * time.Minute
 )
 
 type (
@@ -28,23 +51,152 @@ type (
 	// Инкапсулирует создание общих зависимостей (БД, кэш) и инициализацию модулей.
 	// Служит точкой входа для настройки всей архитектуры приложения.
 	Manager struct {
-		connection *database.Connection
-		cache      *inmemory.Cache
+		wal *wal.Log
 
 		// Менеджер модуля баннеров, предоставляющий доступ к его функциональности.
 		Banners *banners.Manager
+
+		// Менеджер модуля обслуживания БД (партиции, агрегаты, сроки хранения).
+		Maintenance *maintenance.Manager
 	}
 )
 
 // Новый экземпляр корневого Manager с инициализацией всех модулей.
 // Количество шардов кэша на основе количества CPU ядер (NumCPU * 2) как временное решение
 // для оптимального баланса между производительностью и потреблением памяти.
+// Вид кэша задается CACHE_MODE (mutex или atomic).
+// Журнал упреждающей записи включается переменной окружения WAL_DIR,
+// режим fsync задается WAL_SYNC (batch или interval).
+// Способ записи батчей в БД задается BATCH_MODE (batch, unnest или copy).
+// Лимит пакетного инкремента задается COUNTER_BATCH_LIMIT.
+// Количество месяцев, на которые заранее создаются партиции, задается PARTITION_MONTHS_AHEAD.
+// Сроки хранения данных задаются RETENTION_MINUTE_DAYS, RETENTION_HOURLY_DAYS, RETENTION_DAILY_DAYS
+// (0 или пусто - хранить всегда), RETENTION_DRY_RUN включает режим только отчета.
 // Инициализирует модуль баннеров с предустановленными параметрами воркеров и интервала сброса.
 func New(ctx context.Context, connection *database.Connection) (*Manager, error) {
 
-	cache := inmemory.New(runtime.NumCPU() * 2)
+	var cache model.Store
+
+	switch mode := os.Getenv("CACHE_MODE"); mode {
+	case "", "mutex":
+		cache = inmemory.New(runtime.NumCPU()*2, model.Key.Hash)
+	case "atomic":
+		cache = inmemory.NewAtomic(runtime.NumCPU()*2, model.Key.Hash)
+	default:
+		return nil, fmt.Errorf("unknown cache mode: %s", mode)
+	}
+
+	var journal *wal.Log
+
+	if dir := os.Getenv("WAL_DIR"); dir != "" {
+		mode, err := wal.ParseSyncMode(os.Getenv("WAL_SYNC"))
+		if err != nil {
+			return nil, err
+		}
+		if journal, err = wal.New(dir, mode, walSyncInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	mode, err := repository.ParseMode(os.Getenv("BATCH_MODE"))
+	if err != nil {
+		return nil, err
+	}
+
+	limit := batchLimit
+
+	if s := os.Getenv("COUNTER_BATCH_LIMIT"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid COUNTER_BATCH_LIMIT: %s", s)
+		}
+	}
+
+	ahead := monthsAhead
+
+	if s := os.Getenv("PARTITION_MONTHS_AHEAD"); s != "" {
+		if ahead, err = strconv.Atoi(s); err != nil || ahead < 0 {
+			return nil, fmt.Errorf("invalid PARTITION_MONTHS_AHEAD: %s", s)
+		}
+	}
+
+	retention, err := retentionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	banners, err := banners.New(ctx, connection, cache, journal, banners.Config{
+		Mode:       mode,
+		Workers:    workers,
+		Interval:   interval,
+		BatchLimit: limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := maintenance.New(ctx, connection, maintenance.Config{
+		MonthsAhead:    ahead,
+		Interval:       maintenanceInterval,
+		RollupInterval: rollupInterval,
+		Retention:      retention,
+	})
 
 	return &Manager{
-		Banners: banners.New(ctx, connection, cache, workers, interval),
+		wal:         journal,
+		Banners:     banners,
+		Maintenance: maintenance,
 	}, nil
 }
+
+// Читает политику хранения данных из переменных окружения.
+func retentionFromEnv() (maintenancemodel.Retention, error) {
+	var (
+		retention maintenancemodel.Retention
+		err       error
+	)
+
+	for name, d := range map[string]*time.Duration{
+		"RETENTION_MINUTE_DAYS": &retention.Minute,
+		"RETENTION_HOURLY_DAYS": &retention.Hourly,
+		"RETENTION_DAILY_DAYS":  &retention.Daily,
+	} {
+		s := os.Getenv(name)
+		if s == "" {
+			continue
+		}
+
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 0 {
+			return retention, fmt.Errorf("invalid %s: %s", name, s)
+		}
+		*d = time.Duration(days) * 24 * time.Hour
+	}
+
+	if s := os.Getenv("RETENTION_DRY_RUN"); s != "" {
+		if retention.DryRun, err = strconv.ParseBool(s); err != nil {
+			return retention, fmt.Errorf("invalid RETENTION_DRY_RUN: %s", s)
+		}
+	}
+
+	return retention, retention.Validate()
+}
+
+// Закрывает долгие потоковые запросы модулей (live-потоки).
+// Вызывается в начале остановки HTTP сервера, иначе она ждала бы их до таймаута.
+func (m *Manager) CloseStreams() {
+	m.Banners.CloseStreams()
+}
+
+// Корректно останавливает все модули приложения.
+// Вызывается после остановки HTTP сервера, но до закрытия соединения с БД.
+func (m *Manager) Shutdown(ctx context.Context) {
+	m.Maintenance.Shutdown()
+	m.Banners.Shutdown(ctx)
+
+	if m.wal == nil {
+		return
+	}
+	if err := m.wal.Close(); err != nil {
+		log.Printf("Failed to close wal: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package inmemory
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Значение, которым помечается вычитанный счетчик.
+// Прибавление к нему дает отрицательный результат, по которому писатель узнает,
+// что счетчик выведен из оборота и нужно создать новый.
+const retired = math.MinInt64
+
+type (
+	// atomicShard представляет сегмент атомарного кэша.
+	// Счетчики хранятся как *atomic.Int64, поэтому инкремент существующего ключа не берет блокировок.
+	atomicShard[K comparable] struct {
+		m sync.Map // K -> *atomic.Int64
+
+		_ [16]byte // padding чтобы избежать false sharing (sync.Map занимает 48 байт, 64 байта на кэш линию)
+	}
+
+	// Atomic реализует шардированный кэш счетчиков без блокировок на горячем пути.
+	// Блокировка (внутри sync.Map) берется только при первой записи ключа после сброса.
+	// Значения счетчиков должны быть неотрицательными: отрицательное значение означает выведенный счетчик.
+	Atomic[K comparable] struct {
+		shards []*atomicShard[K]
+
+		hash func(K) int
+	}
+)
+
+// Новый экземпляр Atomic с указанным количеством шардов.
+// Функция hash определяет шард ключа и должна возвращать неотрицательное значение.
+func NewAtomic[K comparable](size int, hash func(K) int) *Atomic[K] {
+	shards := make([]*atomicShard[K], size)
+	for i := range shards {
+		shards[i] = &atomicShard[K]{}
+	}
+	return &Atomic[K]{shards, hash}
+}
+
+// Номер шарда, в который попадает ключ.
+func (c *Atomic[K]) Shard(key K) int {
+	return c.hash(key) % len(c.shards)
+}
+
+// Количество шардов кэша.
+func (c *Atomic[K]) Len() int {
+	return len(c.shards)
+}
+
+// Увеличивает счетчик ключа на положительное delta.
+// Для существующего ключа это один атомарный Add.
+func (c *Atomic[K]) Add(key K, delta int64) {
+	sh := c.shards[c.Shard(key)]
+
+	for {
+		v, ok := sh.m.Load(key)
+		if !ok {
+			v, _ = sh.m.LoadOrStore(key, new(atomic.Int64))
+		}
+
+		counter := v.(*atomic.Int64)
+		if counter.Add(delta) >= 0 {
+			return
+		}
+
+		// Счетчик вычитан сбросом: убираем его, если сброс еще не успел, и пробуем заново.
+		sh.m.CompareAndDelete(key, counter)
+	}
+}
+
+// Вычитывает шард i в пустой буфер buf и возвращает его.
+// Каждый счетчик атомарно обменивается на метку retired и удаляется,
+// поэтому записи, пришедшие после обмена, попадут в новый счетчик и не потеряются.
+func (c *Atomic[K]) Drain(i int, buf map[K]int64) map[K]int64 {
+	sh := c.shards[i]
+
+	sh.m.Range(func(k, v any) bool {
+		counter := v.(*atomic.Int64)
+
+		if n := counter.Swap(retired); n > 0 {
+			buf[k.(K)] += n
+		}
+		sh.m.CompareAndDelete(k, counter)
+
+		return true
+	})
+
+	return buf
+}
+
+// Обходит текущие значения счетчиков без блокировок.
+// Выведенные сбросом счетчики пропускаются.
+func (c *Atomic[K]) Range(fn func(K, int64)) {
+	for i := range c.shards {
+		c.RangeShard(i, fn)
+	}
+}
+
+// Обходит текущие значения счетчиков шарда i без блокировок.
+func (c *Atomic[K]) RangeShard(i int, fn func(K, int64)) {
+	c.shards[i].m.Range(func(k, v any) bool {
+		if n := v.(*atomic.Int64).Load(); n > 0 {
+			fn(k.(K), n)
+		}
+		return true
+	})
+}
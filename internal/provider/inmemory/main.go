@@ -7,10 +7,10 @@ import (
 type (
 	// shard представляет отдельный сегмент кэша с собственной блокировкой.
 	// Использует мьютекс для обеспечения потокобезопасной операций с данными.
-	// Data хранит маппинг ID баннера на значение счетчика.
-	shard struct {
+	// Data хранит маппинг ключа счетчика на его значение.
+	shard[K comparable] struct {
 		Mu   sync.Mutex
-		Data map[int]int64
+		Data map[K]int64
 
 		// False sharing (ложное разделение) — это явление, при котором разные потоки обращаются к разным переменным,
 		// Но эти переменные лежат рядом в памяти и попадают в одну кэш-линию процессора.
@@ -20,25 +20,77 @@ type (
 
 	// Cache реализует шардированный in-memory кэш для высокопроизводительного хранения счетчиков.
 	// Использует множественные шарды для минимизации конкуренции между горутинами.
-	// Распределение по шардам происходит на основе хэша ID баннера.
-	Cache struct {
-		Shards []*shard
+	// Распределение по шардам происходит на основе хэша ключа.
+	Cache[K comparable] struct {
+		Shards []*shard[K]
+
+		hash func(K) int
 	}
 )
 
 // Новый экземпляр Cache с указанным количеством шардов.
 // Большее количество шардов уменьшает конкуренцию, но увеличивает накладные расходы.
 // Рекомендуется использовать количество шардов равное количеству CPU ядер!.
-func New(size int) *Cache {
-	shards := make([]*shard, size)
+// Функция hash определяет шард ключа и должна возвращать неотрицательное значение.
+func New[K comparable](size int, hash func(K) int) *Cache[K] {
+	shards := make([]*shard[K], size)
 	for i := range shards {
-		shards[i] = &shard{Data: make(map[int]int64)}
+		shards[i] = &shard[K]{Data: make(map[K]int64)}
 	}
-	return &Cache{shards}
+	return &Cache[K]{shards, hash}
+}
+
+// Возвращает шард для указанного ключа.
+// Использует простое деление хэша по модулю для быстрого распределения.
+func (c *Cache[K]) GetShard(key K) *shard[K] {
+	return c.Shards[c.hash(key)%len(c.Shards)]
+}
+
+// Номер шарда, в который попадает ключ.
+func (c *Cache[K]) Shard(key K) int {
+	return c.hash(key) % len(c.Shards)
+}
+
+// Количество шардов кэша.
+func (c *Cache[K]) Len() int {
+	return len(c.Shards)
+}
+
+// Увеличивает счетчик ключа на delta под блокировкой шарда.
+func (c *Cache[K]) Add(key K, delta int64) {
+	sh := c.GetShard(key)
+
+	sh.Mu.Lock()
+	sh.Data[key] += delta
+	sh.Mu.Unlock()
 }
 
-// Возвращает шард для указанного ID баннера.
-// Использует простое деление по модулю для быстрого распределения.
-func (c *Cache) GetShard(id int) *shard {
-	return c.Shards[id%len(c.Shards)]
+// Вычитывает шард i, подменяя его данные пустым буфером buf.
+// Возвращает вычитанные данные, которые переходят в распоряжение вызывающего.
+func (c *Cache[K]) Drain(i int, buf map[K]int64) map[K]int64 {
+	sh := c.Shards[i]
+
+	sh.Mu.Lock()
+	sh.Data, buf = buf, sh.Data
+	sh.Mu.Unlock()
+
+	return buf
+}
+
+// Обходит текущие значения счетчиков, блокируя шарды по одному.
+func (c *Cache[K]) Range(fn func(K, int64)) {
+	for i := range c.Shards {
+		c.RangeShard(i, fn)
+	}
+}
+
+// Обходит текущие значения счетчиков шарда i под его блокировкой.
+func (c *Cache[K]) RangeShard(i int, fn func(K, int64)) {
+	sh := c.Shards[i]
+
+	sh.Mu.Lock()
+	for k, v := range sh.Data {
+		fn(k, v)
+	}
+	sh.Mu.Unlock()
 }
@@ -6,8 +6,10 @@ import (
 	"testing"
 )
 
+func id(i int) int { return i }
+
 func BenchmarkCache_GetShard(b *testing.B) {
-	cache := New(128)
+	cache := New(128, id)
 
 	for i := 0; b.Loop(); i++ {
 		cache.GetShard(i)
@@ -15,7 +17,7 @@ func BenchmarkCache_GetShard(b *testing.B) {
 }
 
 func BenchmarkCache_Increment_Sequential(b *testing.B) {
-	cache := New(128)
+	cache := New(128, id)
 
 	for i := 0; b.Loop(); i++ {
 		sh := cache.GetShard(i)
@@ -26,23 +28,23 @@ func BenchmarkCache_Increment_Sequential(b *testing.B) {
 }
 
 func BenchmarkCache_Increment_Parallel(b *testing.B) {
-	cache := New(runtime.NumCPU() * 2)
+	cache := New(runtime.NumCPU()*2, id)
 
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
-		id := 0
+		key := 0
 		for pb.Next() {
-			sh := cache.GetShard(id)
+			sh := cache.GetShard(key)
 			sh.Mu.Lock()
-			sh.Data[id]++
+			sh.Data[key]++
 			sh.Mu.Unlock()
-			id++
+			key++
 		}
 	})
 }
 
 func BenchmarkCache_Increment_Contention(b *testing.B) {
-	cache := New(1) // Один шард = максимальная конкуренция
+	cache := New(1, id) // Один шард = максимальная конкуренция
 
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
@@ -60,7 +62,7 @@ func BenchmarkCache_Distribution(b *testing.B) {
 
 	for _, shardCount := range shards {
 		b.Run(string(rune('0'+shardCount/10))+string(rune('0'+shardCount%10)), func(b *testing.B) {
-			cache := New(shardCount)
+			cache := New(shardCount, id)
 			var wg sync.WaitGroup
 
 			b.ResetTimer()
@@ -69,10 +71,10 @@ func BenchmarkCache_Distribution(b *testing.B) {
 				go func(start int) {
 					defer wg.Done()
 					for j := 0; j < b.N/runtime.NumCPU(); j++ {
-						id := start*1000 + j
-						sh := cache.GetShard(id)
+						key := start*1000 + j
+						sh := cache.GetShard(key)
 						sh.Mu.Lock()
-						sh.Data[id]++
+						sh.Data[key]++
 						sh.Mu.Unlock()
 					}
 				}(i)
@@ -81,3 +83,74 @@ func BenchmarkCache_Distribution(b *testing.B) {
 		})
 	}
 }
+
+// Общий интерфейс Cache и Atomic для сравнения в бенчмарках.
+type store interface {
+	Len() int
+	Add(int, int64)
+	Drain(int, map[int]int64) map[int]int64
+}
+
+func stores(size int) map[string]store {
+	return map[string]store{
+		"mutex":  New(size, id),
+		"atomic": NewAtomic(size, id),
+	}
+}
+
+func BenchmarkStore_Add_Parallel(b *testing.B) {
+	for name, cache := range stores(runtime.NumCPU() * 2) {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				key := 0
+				for pb.Next() {
+					cache.Add(key%1024, 1)
+					key++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStore_Add_Contention(b *testing.B) {
+	for name, cache := range stores(1) { // Один горячий ключ = максимальная конкуренция
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					cache.Add(1, 1)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStore_Add_WithDrain(b *testing.B) {
+	for name, cache := range stores(runtime.NumCPU() * 2) {
+		b.Run(name, func(b *testing.B) {
+			done := make(chan struct{})
+			go func() {
+				buf := make(map[int]int64)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					for i := range cache.Len() {
+						buf = cache.Drain(i, buf)
+						clear(buf)
+					}
+				}
+			}()
+
+			b.RunParallel(func(pb *testing.PB) {
+				key := 0
+				for pb.Next() {
+					cache.Add(key%1024, 1)
+					key++
+				}
+			})
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/aaoreshkin/click-counter/internal/provider/database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Версия схемы, к которой не применена ни одна миграция.
+const NilVersion int64 = -1
+
+// Ключ advisory-блокировки миграций: реплики, запущенные с --migrate-on-start, применяют миграции по очереди.
+const lockKey int64 = 0x62635f6d6967 // "bc_mig"
+
+var (
+	// Предыдущая миграция завершилась с ошибкой: схема в неизвестном состоянии.
+	ErrDirty = errors.New("database schema is dirty")
+
+	// Схема БД старше, чем ожидает код.
+	ErrOutdated = errors.New("database schema is outdated")
+
+	// Формат имени файла миграции, как в golang-migrate.
+	filename = regexp.MustCompile(`^([0-9]+)_(.*)\.(up|down)\.sql$`)
+)
+
+type (
+	// SQL миграция: пара файлов {version}_{name}.up.sql и {version}_{name}.down.sql.
+	Migration struct {
+		Version int64
+		Name    string
+		Up      string
+		Down    string
+	}
+
+	// Шаг применения миграций: миграция, направление и версия схемы после шага.
+	step struct {
+		migration Migration
+		up        bool
+		version   int64
+	}
+
+	// Migrator применяет миграции к БД.
+	// Версия схемы хранится в таблице schema_migrations в формате golang-migrate,
+	// поэтому с одной БД можно работать и сервисом, и migrate CLI.
+	Migrator struct {
+		connection *database.Connection
+		migrations []Migration // По возрастанию версии.
+	}
+)
+
+// Новый экземпляр Migrator с подключением к БД и миграциями из fsys.
+func New(connection *database.Connection, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Parse(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		connection,
+		migrations,
+	}, nil
+}
+
+// Читает миграции из корня fsys, отсортированные по возрастанию версии.
+// Файлы с другими именами пропускаются. У каждой миграции должны быть оба файла.
+func Parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		match := filename.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s", entry.Name())
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("duplicate migration version: %d", version)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+
+	return migrations, nil
+}
+
+// Все миграции по возрастанию версии.
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Последняя версия схемы, которую знает код.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return NilVersion
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Текущая версия схемы и признак dirty.
+func (m *Migrator) Version(ctx context.Context) (version int64, dirty bool, err error) {
+	err = m.locked(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err = m.version(ctx, conn)
+		return err
+	})
+	return version, dirty, err
+}
+
+// Применяет n следующих миграций, все при n <= 0.
+func (m *Migrator) Up(ctx context.Context, n int) error {
+	return m.migrate(ctx, func(current int64) (int64, error) {
+		pending := m.migrations[m.next(current):]
+		if len(pending) == 0 {
+			return current, nil
+		}
+		if n <= 0 || n > len(pending) {
+			n = len(pending)
+		}
+		return pending[n-1].Version, nil
+	})
+}
+
+// Откатывает n последних миграций, все при n <= 0.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.migrate(ctx, func(current int64) (int64, error) {
+		i, err := m.index(current)
+		if err != nil || i < 0 {
+			return current, err
+		}
+		if n <= 0 || n > i {
+			return NilVersion, nil
+		}
+		return m.migrations[i-n].Version, nil
+	})
+}
+
+// Применяет или откатывает миграции до версии version.
+func (m *Migrator) Goto(ctx context.Context, version int64) error {
+	if _, err := m.index(version); err != nil {
+		return err
+	}
+	return m.migrate(ctx, func(int64) (int64, error) {
+		return version, nil
+	})
+}
+
+// Устанавливает версию схемы без выполнения миграций и снимает признак dirty.
+// Используется для восстановления после ошибки миграции, когда схема исправлена вручную.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	if version < NilVersion {
+		return fmt.Errorf("invalid version: %d", version)
+	}
+	return m.locked(ctx, func(conn *pgxpool.Conn) error {
+		return setVersion(ctx, conn, version, false)
+	})
+}
+
+// Проверяет, что схема БД не старше последней миграции и не в состоянии dirty.
+// Схема новее кода допускается: так работает откат сервиса на предыдущую версию,
+// если новые миграции совместимы с ним.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w at version %d, fix it and run migrate force", ErrDirty, version)
+	}
+	if latest := m.Latest(); version < latest {
+		return fmt.Errorf("%w: version %d, expected %d, run migrate up", ErrOutdated, version, latest)
+	}
+	return nil
+}
+
+// Переводит схему к версии, которую target вычисляет по текущей версии.
+func (m *Migrator) migrate(ctx context.Context, target func(current int64) (int64, error)) error {
+	return m.locked(ctx, func(conn *pgxpool.Conn) error {
+		current, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("%w at version %d, fix it and run migrate force", ErrDirty, current)
+		}
+
+		version, err := target(current)
+		if err != nil {
+			return err
+		}
+
+		steps, err := m.plan(current, version)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range steps {
+			if err := m.run(ctx, conn, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Возвращает шаги перехода от версии current к версии target.
+// Вверх применяются миграции новее current до target включительно,
+// вниз - откатываются миграции от current до target исключительно.
+func (m *Migrator) plan(current, target int64) ([]step, error) {
+	var steps []step
+
+	if target >= current {
+		for _, migration := range m.migrations[m.next(current):] {
+			if migration.Version > target {
+				break
+			}
+			steps = append(steps, step{migration, true, migration.Version})
+		}
+		return steps, nil
+	}
+
+	i, err := m.index(current)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; i >= 0 && m.migrations[i].Version > target; i-- {
+		version := NilVersion
+		if i > 0 {
+			version = m.migrations[i-1].Version
+		}
+		steps = append(steps, step{m.migrations[i], false, version})
+	}
+	return steps, nil
+}
+
+// Выполняет шаг как golang-migrate: версия шага помечается dirty, выполняется SQL миграции
+// и признак снимается. Если SQL завершился ошибкой, версия остается dirty до migrate force.
+// Файл миграции выполняется одним запросом по простому протоколу, то есть в неявной транзакции.
+func (m *Migrator) run(ctx context.Context, conn *pgxpool.Conn, s step) error {
+	if err := setVersion(ctx, conn, s.version, true); err != nil {
+		return err
+	}
+
+	body, direction := s.migration.Up, "up"
+	if !s.up {
+		body, direction = s.migration.Down, "down"
+	}
+
+	if _, err := conn.Exec(ctx, body); err != nil {
+		return fmt.Errorf("migration %d_%s %s: %w", s.migration.Version, s.migration.Name, direction, err)
+	}
+
+	return setVersion(ctx, conn, s.version, false)
+}
+
+// Индекс первой миграции новее version.
+func (m *Migrator) next(version int64) int {
+	i, _ := slices.BinarySearchFunc(m.migrations, version+1, func(m Migration, v int64) int {
+		return cmp.Compare(m.Version, v)
+	})
+	return i
+}
+
+// Индекс миграции с версией version, -1 для NilVersion.
+func (m *Migrator) index(version int64) (int, error) {
+	if version == NilVersion {
+		return -1, nil
+	}
+
+	i, ok := slices.BinarySearchFunc(m.migrations, version, func(m Migration, v int64) int {
+		return cmp.Compare(m.Version, v)
+	})
+	if !ok {
+		return 0, fmt.Errorf("unknown migration version: %d", version)
+	}
+	return i, nil
+}
+
+// Выполняет fn на отдельном соединении под advisory-блокировкой миграций,
+// предварительно создав таблицу версии схемы. Ждет, пока блокировку держит другой процесс.
+func (m *Migrator) locked(ctx context.Context, fn func(*pgxpool.Conn) error) error {
+	conn, err := m.connection.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		conn.Release()
+		return err
+	}
+
+	defer func() {
+		// Контекст может быть уже отменен, а блокировку нужно снять в любом случае.
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			// Соединение с неснятой блокировкой не возвращается в пул: блокировка снимется при его закрытии.
+			conn.Hijack().Close(context.Background())
+			return
+		}
+		conn.Release()
+	}()
+
+	const schema = `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`
+	if _, err := conn.Exec(ctx, schema); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// Текущая версия схемы. NilVersion, если миграции не применялись.
+func (m *Migrator) version(ctx context.Context, conn *pgxpool.Conn) (int64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NilVersion, false, nil
+	}
+	return version, dirty, err
+}
+
+// Записывает версию схемы в одной транзакции. Чистая NilVersion хранится пустой таблицей.
+func setVersion(ctx context.Context, conn *pgxpool.Conn, version int64, dirty bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `TRUNCATE schema_migrations`); err != nil {
+		return err
+	}
+
+	if version != NilVersion || dirty {
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
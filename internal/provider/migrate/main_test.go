@@ -0,0 +1,67 @@
+package migrate
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/aaoreshkin/click-counter/migrations"
+)
+
+func TestParse_Embedded(t *testing.T) {
+	list, err := Parse(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Version >= list[i].Version {
+			t.Fatalf("migrations are not sorted: %d before %d", list[i-1].Version, list[i].Version)
+		}
+	}
+
+	// Миграция без файла отката не принимается.
+	if _, err := Parse(fstest.MapFS{"1_a.up.sql": {Data: []byte("SELECT 1")}}); err == nil {
+		t.Fatal("expected error for migration without down file")
+	}
+}
+
+func TestMigrator_Plan(t *testing.T) {
+	m := &Migrator{migrations: []Migration{{Version: 10}, {Version: 20}, {Version: 30}}}
+
+	versions := func(steps []step) (out []int64) {
+		for _, s := range steps {
+			if !s.up {
+				s.migration.Version = -s.migration.Version
+			}
+			out = append(out, s.migration.Version, s.version)
+		}
+		return out
+	}
+
+	for _, c := range []struct {
+		current, target int64
+		want            []int64
+	}{
+		{NilVersion, 20, []int64{10, 10, 20, 20}},
+		{20, 30, []int64{30, 30}},
+		{30, 10, []int64{-30, 20, -20, 10}},
+		{10, NilVersion, []int64{-10, NilVersion}},
+		{30, 30, nil},
+	} {
+		steps, err := m.plan(c.current, c.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := versions(steps); !slices.Equal(got, c.want) {
+			t.Fatalf("plan(%d, %d) = %v, want %v", c.current, c.target, got, c.want)
+		}
+	}
+
+	// Откат с неизвестной версии невозможен: неизвестно, какие миграции применены.
+	if _, err := m.plan(25, 10); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+}
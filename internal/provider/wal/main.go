@@ -0,0 +1,417 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Версия формата записей, которые пишет журнал.
+	// Запись: ID (8 байт) + метрика (1 байт) + минута (8 байт) + значение (8 байт) + контрольная сумма (4 байта).
+	version = 3
+
+	// Размер записи.
+	size = 29
+
+	// Заголовок сегмента: magic (6 байт) + версия формата записей (2 байта).
+	headerSize = 8
+
+	// Расширение файлов сегментов журнала.
+	ext = ".wal"
+)
+
+// Начало заголовка сегмента.
+var magic = []byte("CCWAL\x00")
+
+const (
+	// Fsync после каждой группы записей (group commit).
+	// Append возвращает управление только после того, как запись попала на диск.
+	SyncBatch SyncMode = iota
+
+	// Fsync по интервалу.
+	// Append только буферизует запись, при сбое теряется не более одного интервала.
+	SyncInterval
+)
+
+type (
+	// Режим синхронизации журнала с диском.
+	SyncMode int
+
+	// Запись журнала: приращение счетчика метрики баннера в минуте события.
+	Record struct {
+		ID     int64
+		Metric uint8
+		TS     int64 // Начало минуты события, unix секунды.
+		Delta  int64
+	}
+
+	// Log реализует журнал упреждающей записи (WAL) для счетчиков.
+	// Журнал разбит на сегменты: текущий сегмент принимает новые записи,
+	// запечатанные сегменты удаляются после подтверждения записи данных в БД.
+	Log struct {
+		dir  string
+		mode SyncMode
+
+		mu   sync.Mutex
+		cond *sync.Cond
+		file *os.File // Текущий сегмент.
+		seq  uint64   // Номер текущего сегмента.
+
+		buf     []byte // Записи, еще не записанные в файл.
+		spare   []byte // Переиспользуемый буфер для записи на диск.
+		writing bool   // Идет запись буфера на диск.
+		pending uint64 // Поколение записей в buf.
+		synced  uint64 // Последнее поколение, записанное на диск.
+		err     error  // Ошибка последней записи на диск.
+
+		done chan struct{}
+		wg   sync.WaitGroup
+	}
+)
+
+// Разбирает режим синхронизации из строки: "batch" (по умолчанию) или "interval".
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch s {
+	case "", "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return 0, fmt.Errorf("unknown wal sync mode: %s", s)
+}
+
+// Новый журнал в указанной директории.
+// Существующие сегменты не удаляются: их нужно воспроизвести через Replay.
+// Новые записи пишутся в новый сегмент. Interval используется только в режиме SyncInterval.
+func New(dir string, mode SyncMode, interval time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := list(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:     dir,
+		mode:    mode,
+		pending: 1,
+		done:    make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mu)
+
+	if len(segments) > 0 {
+		l.seq = segments[len(segments)-1]
+	}
+	if l.file, err = l.create(l.seq + 1); err != nil {
+		return nil, err
+	}
+	l.seq++
+
+	if mode == SyncInterval {
+		l.wg.Add(1)
+		go l.loop(interval)
+	}
+
+	return l, nil
+}
+
+// Воспроизводит все записи из запечатанных сегментов в порядке их создания.
+// Сегмент другой версии формата - ошибка.
+// Оборванная или поврежденная запись в конце сегмента (сбой во время записи) пропускается с записью в лог.
+func (l *Log) Replay(fn func(Record)) error {
+	segments, err := list(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq >= l.seq {
+			break
+		}
+		if err := replay(l.path(seq), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Добавляет записи в журнал.
+// В режиме SyncBatch блокируется до fsync группы, в которую попали записи.
+func (l *Log) Append(records ...Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, r := range records {
+		l.buf = encode(l.buf, r)
+	}
+
+	if l.mode == SyncInterval {
+		return nil
+	}
+
+	// Group commit: первая горутина, заставшая журнал свободным, пишет на диск
+	// все накопленные записи, остальные дожидаются своего поколения.
+	gen := l.pending
+	for l.synced < gen {
+		if l.writing {
+			l.cond.Wait()
+			continue
+		}
+		l.sync()
+	}
+	return l.err
+}
+
+// Запечатывает текущий сегмент и начинает новый.
+// Возвращает номер запечатанного сегмента для последующего Release.
+// Если новый сегмент создать не удалось, записи продолжают идти в текущий.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.writing {
+		l.cond.Wait()
+	}
+	if len(l.buf) > 0 {
+		l.sync()
+	}
+
+	file, err := l.create(l.seq + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed, old := l.seq, l.file
+	l.file, l.seq = file, sealed+1
+	return sealed, old.Close()
+}
+
+// Удаляет запечатанные сегменты с номером не больше upTo.
+// Вызывается, когда все данные из этих сегментов подтверждены БД.
+func (l *Log) Release(upTo uint64) error {
+	segments, err := list(l.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	for _, seq := range segments {
+		if seq > upTo || seq == l.current() {
+			break
+		}
+		if err := os.Remove(l.path(seq)); err != nil {
+			return err
+		}
+		removed = true
+	}
+
+	if !removed {
+		return nil
+	}
+	return syncDir(l.dir)
+}
+
+// Записывает буфер на диск и закрывает журнал.
+// Сегменты остаются на диске до следующего запуска.
+func (l *Log) Close() error {
+	close(l.done)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.writing {
+		l.cond.Wait()
+	}
+	if len(l.buf) > 0 {
+		l.sync()
+	}
+	return errors.Join(l.err, l.file.Close())
+}
+
+// Периодически записывает буфер на диск в режиме SyncInterval.
+func (l *Log) loop(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if !l.writing && len(l.buf) > 0 {
+				l.sync()
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Записывает накопленный буфер в текущий сегмент и выполняет fsync.
+// Вызывается под блокировкой, на время записи на диск блокировка отпускается.
+func (l *Log) sync() {
+	data, gen, file := l.buf, l.pending, l.file
+
+	l.buf = l.spare[:0]
+	l.pending++
+	l.writing = true
+	l.mu.Unlock()
+
+	_, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	l.mu.Lock()
+	l.spare = data
+	l.writing = false
+	l.synced = gen
+	l.err = err
+	l.cond.Broadcast()
+}
+
+// Создает сегмент с указанным номером и пишет в него заголовок.
+// Заголовок попадает на диск с первым fsync записей сегмента, запись о файле в директории - сразу.
+// Сегмент, оставшийся от неудачной попытки, перезаписывается.
+func (l *Log) create(seq uint64) (*os.File, error) {
+	file, err := os.OpenFile(l.path(seq), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	header := binary.LittleEndian.AppendUint16(slices.Clone(magic), version)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := syncDir(l.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (l *Log) current() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq
+}
+
+func (l *Log) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+// Выполняет fsync директории, чтобы создание и удаление сегментов пережили сбой.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// Возвращает отсортированные номера сегментов в директории.
+func list(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ext)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	slices.Sort(segments)
+
+	return segments, nil
+}
+
+// Читает записи сегмента до конца файла или первой поврежденной записи.
+func replay(path string, fn func(Record)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	data, err = records(data)
+	if err != nil {
+		return fmt.Errorf("wal segment %s: %w", path, err)
+	}
+
+	for offset := 0; offset+size <= len(data); offset += size {
+		r, ok := decode(data[offset : offset+size])
+		if !ok {
+			log.Printf("WAL segment %s: corrupted record at offset %d, %d bytes skipped", path, offset, len(data)-offset)
+			return nil
+		}
+		fn(r)
+	}
+
+	if tail := len(data) % size; tail != 0 {
+		log.Printf("WAL segment %s: incomplete record at the end, %d bytes skipped", path, tail)
+	}
+	return nil
+}
+
+// Проверяет заголовок сегмента и возвращает записи без заголовка.
+// Оборванный при создании сегмент считается пустым.
+func records(data []byte) ([]byte, error) {
+	if len(data) < headerSize && bytes.HasPrefix(magic, data) {
+		return nil, nil
+	}
+	if !bytes.HasPrefix(data, magic) || len(data) < headerSize {
+		return nil, errors.New("missing header")
+	}
+
+	if v := binary.LittleEndian.Uint16(data[len(magic):]); v != version {
+		return nil, fmt.Errorf("unsupported format version %d", v)
+	}
+	return data[headerSize:], nil
+}
+
+func encode(buf []byte, r Record) []byte {
+	start := len(buf)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.ID))
+	buf = append(buf, r.Metric)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.TS))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Delta))
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+func decode(buf []byte) (Record, bool) {
+	if crc32.ChecksumIEEE(buf[:25]) != binary.LittleEndian.Uint32(buf[25:]) {
+		return Record{}, false
+	}
+	return Record{
+		ID:     int64(binary.LittleEndian.Uint64(buf[0:])),
+		Metric: buf[8],
+		TS:     int64(binary.LittleEndian.Uint64(buf[9:])),
+		Delta:  int64(binary.LittleEndian.Uint64(buf[17:])),
+	}, true
+}
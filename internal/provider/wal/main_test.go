@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"encoding/binary"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLog_ReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := New(dir, SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if err := l.Append(Record{ID: int64(i), Delta: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sealed, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(Record{ID: 7, Delta: 5})
+	l.Close()
+
+	// Оборванная запись в конце сегмента не должна ломать восстановление.
+	f, _ := os.OpenFile(l.path(sealed+1), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	l, err = New(dir, SyncInterval, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got := map[int64]int64{}
+	if err := l.Replay(func(r Record) { got[r.ID] += r.Delta }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || got[7] != 5 {
+		t.Fatalf("unexpected replay: %v", got)
+	}
+
+	if err := l.Release(sealed + 1); err != nil {
+		t.Fatal(err)
+	}
+	got = map[int64]int64{}
+	l.Replay(func(r Record) { got[r.ID] += r.Delta })
+	if len(got) != 0 {
+		t.Fatalf("released segments replayed: %v", got)
+	}
+}
+
+func TestLog_RotateFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := New(dir, SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(Record{ID: 1, Delta: 1})
+
+	// Директория на месте следующего сегмента не дает его создать.
+	next := l.path(l.seq + 1)
+	if err := os.Mkdir(next, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Rotate(); err == nil {
+		t.Fatal("rotate into a directory succeeded")
+	}
+
+	// Текущий сегмент остается открытым и принимает записи.
+	if err := l.Append(Record{ID: 2, Delta: 1}); err != nil {
+		t.Fatalf("append after failed rotate: %v", err)
+	}
+
+	os.Remove(next)
+	if _, err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = New(dir, SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got := map[int64]int64{}
+	if err := l.Replay(func(r Record) { got[r.ID] += r.Delta }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("unexpected replay: %v", got)
+	}
+}
+
+func TestLog_ReplayVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := New(dir, SyncBatch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Сегмент другой версии или без заголовка не пропускается молча.
+	segments := [][]byte{
+		binary.LittleEndian.AppendUint16(slices.Clone(magic), version+1),
+		encode(nil, Record{ID: 1, Delta: 1}),
+	}
+	for _, data := range segments {
+		os.WriteFile(l.path(0), data, 0o644)
+		if err := l.Replay(func(Record) {}); err == nil {
+			t.Fatalf("expected error for segment %x", data)
+		}
+	}
+
+	// Оборванный при создании сегмент считается пустым.
+	os.WriteFile(l.path(0), magic[:3], 0o644)
+	if err := l.Replay(func(Record) { t.Fatal("record replayed from empty segment") }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkLog_Append_Batch(b *testing.B) {
+	l, err := New(b.TempDir(), SyncBatch, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Append(Record{ID: 1, Delta: 1})
+		}
+	})
+}
+
+func BenchmarkLog_Append_Interval(b *testing.B) {
+	l, err := New(b.TempDir(), SyncInterval, 100*time.Millisecond)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Append(Record{ID: 1, Delta: 1})
+		}
+	})
+}
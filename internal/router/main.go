@@ -22,6 +22,7 @@ type (
 // - Мидлвар для автоматической установки Content-Type: application/json
 // - Версионированные роуты под префиксом /v1
 // - Монтирование модуля баннеров по пути /v1/banners
+// - Монтирование служебных эндпоинтов по пути /v1/admin
 // - Эндпоинт проверки состояния /v1/healthcheck, но по большей части для прогрева TCP для тестов
 func New(ctx context.Context, manager *internal.Manager) (*Mux, error) {
 
@@ -31,6 +32,8 @@ func New(ctx context.Context, manager *internal.Manager) (*Mux, error) {
 
 		r.Mount("/banners", router.routeBanners())
 
+		r.Mount("/admin", router.routeAdmin())
+
 		r.Get("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		})
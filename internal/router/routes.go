@@ -13,8 +13,44 @@ func (mux *Mux) routeBanners() chi.Router {
 	// - GET /counter/{bannerID} - инкремент счетчика баннера
 	router.Get("/counter/{bannerID}", controller.HandleClick)
 
+	// - GET /impression/{bannerID} - инкремент счетчика показов баннера
+	router.Get("/impression/{bannerID}", controller.HandleImpression)
+
+	// - GET /conversion/{bannerID} - инкремент счетчика конверсий баннера
+	router.Get("/conversion/{bannerID}", controller.HandleConversion)
+
+	// - POST /counter - пакетный инкремент счетчиков (JSON массив или NDJSON)
+	router.Post("/counter", controller.HandleBatch)
+
 	// - POST /stats/{bannerID} - получение статистики по баннеру за период
 	router.Post("/stats/{bannerID}", controller.HandleStats)
 
+	// - POST /stats/{bannerID}/summary - сводная статистика по баннеру за период
+	router.Post("/stats/{bannerID}/summary", controller.HandleSummary)
+
+	// - POST /stats - получение статистики по нескольким баннерам за период
+	router.Post("/stats", controller.HandleMultiStats)
+
+	// - GET /top - топ баннеров по кликам за период
+	router.Get("/top", controller.HandleTop)
+
+	// - GET /{bannerID}/live - поток счетчиков баннера за текущую минуту (Server-Sent Events)
+	router.Get("/{bannerID}/live", controller.HandleLive)
+
+	return router
+}
+
+// Регистрирует служебные эндпоинты:
+func (mux *Mux) routeAdmin() chi.Router {
+	router := chi.NewRouter()
+
+	maintenance := mux.manager.Maintenance.Controller()
+
+	// - GET /partitions - текущие партиции banners_counter
+	router.Get("/partitions", maintenance.HandlePartitions)
+
+	// - GET /retention - что удалила бы политика хранения (dry-run)
+	router.Get("/retention", maintenance.HandleRetention)
+
 	return router
 }
@@ -3,19 +3,26 @@
 # Загрузка переменных окружения
 . ./lib/env.sh
 
+# Ошибка команды миграций завершает скрипт с ее кодом
+set -e
+
+# Миграции встроены в сервис и применяются его командой migrate,
+# внешний golang-migrate CLI нужен только для -drop
+MIGRATE="go run ./cmd migrate"
+
 # Обработка аргументов командной строки
 while [[ "$#" -gt 0 ]]; do
   case "$1" in
   -up)
     # Применение всех неприменённых миграций
     # Безопасная операция - применяет только новые миграции
-    migrate -path migrations -database "${DATABASE_URL}" up
+    $MIGRATE up
     shift
     ;;
   -down)
     # Откат ВСЕХ миграций (ОПАСНО!)
     # Полностью очищает схему БД
-    migrate -path migrations -database "${DATABASE_URL}" down
+    $MIGRATE down -all
     shift
     ;;
   -drop)
@@ -29,7 +36,8 @@ while [[ "$#" -gt 0 ]]; do
     # Создает пару файлов: up и down миграции
     # Требует обязательный параметр - имя миграции
     if [ -n "$2" ]; then
-      migrate create -ext sql -dir migrations "$2"
+      version="$(date -u +%Y%m%d%H%M%S)"
+      touch "migrations/${version}_$2.up.sql" "migrations/${version}_$2.down.sql"
       shift 2
     else
       echo "Error: Missing migration name." >&2
@@ -42,7 +50,7 @@ while [[ "$#" -gt 0 ]]; do
     # Может применять или откатывать миграции для достижения целевой версии
     # Требует номер версии в качестве параметра
     if [ -n "$2" ]; then
-      migrate -path migrations -database "${DATABASE_URL}" goto "$2"
+      $MIGRATE goto "$2"
       shift 2
     else
       echo "Error: Missing version number." >&2
@@ -50,12 +58,17 @@ while [[ "$#" -gt 0 ]]; do
       exit 1
     fi
     ;;
+  -status)
+    # Текущая версия схемы и список миграций
+    $MIGRATE status
+    shift
+    ;;
   -fix)
     # Принудительная установка версии миграции (для исправления ошибок)
     # Используется когда миграция завершилась с ошибкой и нужно исправить состояние
     # ОСТОРОЖНО: не выполняет саму миграцию, только обновляет версию в schema_migrations
     if [ -n "$2" ]; then
-      migrate -path migrations -database "${DATABASE_URL}" force "$2"
+      $MIGRATE force "$2"
       shift 2
     else
       echo "Error: Missing version number for fix." >&2
@@ -74,11 +87,12 @@ while [[ "$#" -gt 0 ]]; do
     echo "  -create <name>         Create new migration files" >&2
     echo "  -goto <version>        Migrate to specific version" >&2
     echo "  -fix <version>         Force set migration version (for error recovery)" >&2
+    echo "  -status                Show schema version and migrations" >&2
     echo "" >&2
     echo "Examples:" >&2
     echo "  ./migrate.sh -up" >&2
     echo "  ./migrate.sh -create add_users_table" >&2
-    echo "  ./migrate.sh -goto 1" >&2
+    echo "  ./migrate.sh -goto 20261018110000" >&2
     exit 1
     ;;
   esac
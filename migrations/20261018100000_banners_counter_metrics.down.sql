@@ -0,0 +1,4 @@
+ALTER TABLE banners_counter
+    DROP COLUMN IF EXISTS impressions,
+    DROP COLUMN IF EXISTS conversions;
+
@@ -0,0 +1,5 @@
+-- v остается счетчиком кликов
+ALTER TABLE banners_counter
+    ADD COLUMN IF NOT EXISTS impressions bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS conversions bigint NOT NULL DEFAULT 0;
+
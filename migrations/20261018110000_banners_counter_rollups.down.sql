@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS banners_counter_rollup;
+
+DROP TABLE IF EXISTS banners_counter_daily;
+
+DROP TABLE IF EXISTS banners_counter_hourly;
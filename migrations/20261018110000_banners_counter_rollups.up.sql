@@ -0,0 +1,30 @@
+-- Часовые агрегаты banners_counter, интервалы - часы UTC
+CREATE TABLE IF NOT EXISTS banners_counter_hourly(
+    banner_id bigint NOT NULL,
+    ts timestamptz NOT NULL,
+    v bigint NOT NULL DEFAULT 0,
+    impressions bigint NOT NULL DEFAULT 0,
+    conversions bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (banner_id, ts)
+);
+
+CREATE INDEX IF NOT EXISTS idx_banners_counter_hourly_ts ON banners_counter_hourly(ts);
+
+-- Дневные агрегаты banners_counter_hourly, интервалы - сутки UTC
+CREATE TABLE IF NOT EXISTS banners_counter_daily(
+    banner_id bigint NOT NULL,
+    ts timestamptz NOT NULL,
+    v bigint NOT NULL DEFAULT 0,
+    impressions bigint NOT NULL DEFAULT 0,
+    conversions bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (banner_id, ts)
+);
+
+CREATE INDEX IF NOT EXISTS idx_banners_counter_daily_ts ON banners_counter_daily(ts);
+
+-- Покрытие агрегатов: таблица агрегатов содержит все данные за [rolled_from, rolled_to)
+CREATE TABLE IF NOT EXISTS banners_counter_rollup(
+    name text PRIMARY KEY,
+    rolled_from timestamptz NOT NULL,
+    rolled_to timestamptz NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS banners_counter_dirty;
@@ -0,0 +1,8 @@
+-- Интервалы агрегатов, данные которых изменились после расчета: name - уровень из banners_counter_rollup,
+-- ts - начало часа или суток UTC. Сброс счетчиков отмечает часы своих строк, пересчет уровня - интервалы
+-- следующего уровня. Расчет агрегатов пересчитывает отмеченные интервалы и удаляет отметки
+CREATE TABLE IF NOT EXISTS banners_counter_dirty(
+    name text NOT NULL,
+    ts timestamptz NOT NULL,
+    PRIMARY KEY (name, ts)
+);
@@ -0,0 +1,7 @@
+-- Начало хранимых данных таблицы: name - таблица, строки которой раньше horizon удалены по сроку хранения.
+-- Удаление минутных партиций сдвигает horizon banners_counter в одной транзакции с ним, чтение статистики
+-- не читает минутные данные раньше horizon, а сообщает, что они удалены
+CREATE TABLE IF NOT EXISTS banners_counter_retention(
+    name text PRIMARY KEY,
+    horizon timestamptz NOT NULL
+);
@@ -0,0 +1,9 @@
+// Пакет migrations встраивает SQL миграции в бинарник сервиса.
+package migrations
+
+import "embed"
+
+// SQL миграции в формате golang-migrate: {version}_{name}.up.sql и {version}_{name}.down.sql.
+//
+//go:embed *.sql
+var FS embed.FS